@@ -0,0 +1,451 @@
+package lus
+
+/**
+  Authentication and authorization. An Auth_handler sits in front of the other handlers and works out who made each request
+  from one of:
+
+      Authorization: Bearer <token>                             a static token from the config
+      Authorization: LUS-HMAC-SHA256 Key=<id>, Signature=<sig>  a request signed with a shared secret (see SignRequest)
+      a TLS client certificate                                  verified against the client CA, the CN is the name and the OUs the teams
+
+  Requests without any credentials are turned away with a 401 unless anonymous access is allowed. The access rules then decide
+  what the Principal may do e.g.
+
+      "Rules": [
+          {"Name": "billing", "Teams": ["billing"], "Register": {"application": "billing*"}, "Lookup": {}},
+          {"Name": "everyone", "Principals": ["*"], "Lookup": {"env": "prod"}},
+          {"Name": "peers", "Principals": ["lus2"], "Gossip": true},
+          {"Name": "monitoring", "Principals": ["prometheus"], "Metrics": true}
+      ]
+
+  A Principal may register (or modify an entry into) a Service whose keys match the Register patterns (see path.Match) of one of
+  the rules that apply to it, and will only find, watch or be notified about the Services whose keys match the Lookup patterns of
+  one of them. An empty map of patterns matches any keys and leaving it out matches none. Only Principals with a Gossip rule can
+  gossip and only those with a Metrics rule can scrape /metrics. Without any rules an authenticated Principal may do anything. Renewing, modifying or cancelling an entry also needs
+  its lease token, see ids.go.
+**/
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The name given to requests that don't have any credentials.
+const Anonymous_principal = "anonymous"
+
+// The Authorization scheme for HMAC signed requests.
+const Hmac_scheme = "LUS-HMAC-SHA256"
+
+// How far the Date of a signed request can be from our clock. Stops an old request being replayed.
+const Max_clock_skew = 5 * time.Minute
+
+// The header that carries the nonce of a signed request. A nonce is only accepted once, which stops a request being replayed
+// while its Date is still good.
+const Nonce_header = "Lus-Nonce"
+
+// Who made a request.
+type Principal struct {
+	Name  string
+	Teams []string `json:",omitempty"`
+}
+
+// A static bearer token and who it belongs to.
+type Auth_token struct {
+	Token string
+	Principal
+}
+
+// A shared secret for signing requests and who it belongs to.
+type Auth_key struct {
+	ID     string
+	Secret string
+	Principal
+}
+
+// What the Principals the rule applies to may do.
+type Access_rule struct {
+	Name       string
+	Principals []string          // Names the rule applies to. * is everyone, including anonymous requests
+	Teams      []string          // Teams the rule applies to
+	Register   map[string]string // Key to a path.Match pattern for the keys that may be registered
+	Lookup     map[string]string // Key to a path.Match pattern for the keys of the Services that may be looked up
+	Gossip     bool              // May gossip as a peer
+	Metrics    bool              // May scrape /metrics
+}
+
+// Check that the rules make sense.
+func validateRules(rules []Access_rule) error {
+	for _, rule := range rules {
+		if len(rule.Principals) == 0 && len(rule.Teams) == 0 {
+			return errors.New("auth: rule " + rule.Name + " doesn't apply to any Principals or Teams")
+		}
+		for _, patterns := range []map[string]string{rule.Register, rule.Lookup} {
+			for k, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return errors.New("auth: the pattern for " + k + " in rule " + rule.Name + " is not valid: " + pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Does the rule apply to the Principal?
+func (rule Access_rule) appliesTo(p *Principal) bool {
+	for _, name := range rule.Principals {
+		if name == "*" || name == p.Name {
+			return true
+		}
+	}
+	for _, team := range rule.Teams {
+		for _, t := range p.Teams {
+			if team == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Do all the patterns match the keys? A nil map of patterns doesn't match anything.
+func keysMatch(patterns map[string]string, keys map[string]string) bool {
+	if patterns == nil {
+		return false
+	}
+	for k, pattern := range patterns {
+		v, ok := keys[k]
+		if !ok {
+			return false
+		}
+		matched, _ := path.Match(pattern, v)
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Works out who made a request. Returns a nil Principal if the request doesn't have the kind of credentials it looks for and an
+// error if it does but they aren't right.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// The scheme and credentials from the Authorization header.
+func authorization(r *http.Request) (string, string) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return scheme, strings.TrimSpace(credentials)
+}
+
+type bearer_authenticator struct {
+	tokens map[string]Principal // By the hash of the token, so that looking one up doesn't give away how much of it was right
+}
+
+// Creates an Authenticator for static bearer tokens.
+func NewBearerAuthenticator(tokens []Auth_token) Authenticator {
+	a := &bearer_authenticator{tokens: make(map[string]Principal)}
+	for _, t := range tokens {
+		a.tokens[hashToken(t.Token)] = t.Principal
+	}
+	return a
+}
+
+func (a *bearer_authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token := authorization(r)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+	p, ok := a.tokens[hashToken(token)]
+	if !ok {
+		return nil, errors.New("The bearer token is not valid")
+	}
+	return &p, nil
+}
+
+type hmac_authenticator struct {
+	keys map[string]Auth_key
+	now  func() time.Time
+
+	mutex      sync.Mutex
+	nonces     map[string]time.Time // The nonces that have been used, until their requests are too old to be accepted anyway
+	next_prune time.Time
+}
+
+// Creates an Authenticator for requests signed with SignRequest.
+func NewHMACAuthenticator(keys []Auth_key) Authenticator {
+	a := &hmac_authenticator{keys: make(map[string]Auth_key), now: time.Now, nonces: make(map[string]time.Time)}
+	for _, k := range keys {
+		a.keys[k.ID] = k
+	}
+	return a
+}
+
+func (a *hmac_authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, credentials := authorization(r)
+	if scheme != Hmac_scheme {
+		return nil, nil
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(credentials, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[k] = v
+	}
+	key, ok := a.keys[params["Key"]]
+	if !ok {
+		return nil, errors.New("The signing key is not known")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, errors.New("A signed request needs a Date")
+	}
+	if skew := a.now().Sub(date); skew > Max_clock_skew || skew < -Max_clock_skew {
+		return nil, errors.New("The Date of the signed request is too far out")
+	}
+	nonce := r.Header.Get(Nonce_header)
+	if nonce == "" {
+		return nil, errors.New("A signed request needs a " + Nonce_header)
+	}
+	// Read the body so that it can be checked, but put it back for the handler. Anything over the limit is left for the handler
+	// to turn down.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(currentLimits().MaxBodySize)+1))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	expected := signature(key.Secret, r, r.Host, body)
+	if !hmac.Equal([]byte(expected), []byte(params["Signature"])) {
+		return nil, errors.New("The signature is not valid")
+	}
+	if !a.firstUse(key.ID+" "+nonce, date.Add(Max_clock_skew)) {
+		return nil, errors.New("The signed request has already been used")
+	}
+	return &key.Principal, nil
+}
+
+// Remembers the nonce until the time given, returning false if it has been seen before.
+func (a *hmac_authenticator) firstUse(nonce string, until time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.now()
+	if now.After(a.next_prune) {
+		for n, t := range a.nonces {
+			if now.After(t) {
+				delete(a.nonces, n)
+			}
+		}
+		a.next_prune = now.Add(Max_clock_skew)
+	}
+	if _, seen := a.nonces[nonce]; seen {
+		return false
+	}
+	a.nonces[nonce] = until
+	return true
+}
+
+// The headers that a signature covers, besides the Date and nonce, as they change what a request does.
+var signed_headers = []string{Lease_token_header, "If-Match", Namespace_header}
+
+// The signature of a request, which covers the method, the host, the path and query, the date, the nonce, the signed_headers
+// and the body.
+func signature(secret string, r *http.Request, host string, body []byte) string {
+	body_hash := sha256.Sum256(body)
+	canonical := []string{r.Method, host, r.URL.RequestURI(), r.Header.Get("Date"), r.Header.Get(Nonce_header)}
+	for _, header := range signed_headers {
+		canonical = append(canonical, r.Header.Get(header))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, strings.Join(append(canonical, hex.EncodeToString(body_hash[:])), "\n"))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Signs the request with the shared secret, setting its Date and nonce if it doesn't have them. Any headers that the signature
+// covers must be set first. The body is read and replaced.
+func SignRequest(r *http.Request, key_id string, secret string) error {
+	var body []byte
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if r.Header.Get(Nonce_header) == "" {
+		r.Header.Set(Nonce_header, newToken())
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	sig := signature(secret, r, host, body)
+	r.Header.Set("Authorization", Hmac_scheme+" Key="+key_id+", Signature="+sig)
+	return nil
+}
+
+type cert_authenticator struct{}
+
+// Creates an Authenticator for TLS client certificates. The server must verify them (see TLS_config.ClientCA) as only verified
+// certificates are looked at. The CN is used for the name and the OUs for the teams.
+func NewCertAuthenticator() Authenticator {
+	return cert_authenticator{}
+}
+
+func (cert_authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	return &Principal{Name: subject.CommonName, Teams: subject.OrganizationalUnit}, nil
+}
+
+// Authenticates every request and passes the Principal and the access rules on to the handlers.
+type Auth_handler struct {
+	handler  http.Handler
+	settings atomic.Pointer[auth_settings]
+}
+
+type auth_settings struct {
+	authenticators []Authenticator
+	anonymous      bool
+	rules          []Access_rule
+}
+
+// Creates an Auth_handler for the handler. If the config doesn't have any credentials then every request is anonymous.
+func NewAuthHandler(handler http.Handler, auth Auth_config) *Auth_handler {
+	a := &Auth_handler{handler: handler}
+	a.SetConfig(auth)
+	return a
+}
+
+// Swap in new credentials and rules.
+func (a *Auth_handler) SetConfig(auth Auth_config) {
+	s := &auth_settings{anonymous: auth.Anonymous || !auth.Enabled()}
+	if len(auth.Rules) > 0 { // Without any rules everyone may do anything
+		s.rules = auth.Rules
+	}
+	if len(auth.Tokens) > 0 {
+		s.authenticators = append(s.authenticators, NewBearerAuthenticator(auth.Tokens))
+	}
+	if len(auth.HMACKeys) > 0 {
+		s.authenticators = append(s.authenticators, NewHMACAuthenticator(auth.HMACKeys))
+	}
+	if auth.ClientCerts {
+		s.authenticators = append(s.authenticators, NewCertAuthenticator())
+	}
+	a.settings.Store(s)
+}
+
+func (a *Auth_handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := a.settings.Load()
+	var principal *Principal
+	for _, authenticator := range s.authenticators {
+		p, err := authenticator.Authenticate(r)
+		if err != nil {
+			writeError(w, unauthorized(w, err.Error()))
+			return
+		}
+		if p != nil {
+			principal = p
+			break
+		}
+	}
+	if principal == nil {
+		if !s.anonymous {
+			writeError(w, unauthorized(w, "Credentials are needed"))
+			return
+		}
+		principal = &Principal{Name: Anonymous_principal}
+	}
+	ctx := context.WithValue(r.Context(), access_key{}, &access{principal: principal, rules: s.rules})
+	a.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func unauthorized(w http.ResponseWriter, message string) *Error {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="lus", `+Hmac_scheme+` realm="lus"`)
+	return newError(http.StatusUnauthorized, Code_unauthorized, message)
+}
+
+// The Principal isn't allowed to do something.
+func notAllowed(p *Principal, message string) *Error {
+	return newError(http.StatusForbidden, Code_forbidden, message).with("Principal", p.Name)
+}
+
+type access_key struct{}
+
+// Who made a request and the rules for what they may do.
+type access struct {
+	principal *Principal
+	rules     []Access_rule // If nil they may do anything, if empty nothing
+}
+
+// The access for the request. Nil if it didn't come through an Auth_handler, in which case anything goes.
+func accessFor(r *http.Request) *access {
+	a, _ := r.Context().Value(access_key{}).(*access)
+	return a
+}
+
+// Does one of the rules that apply to the Principal allow it?
+func (a *access) allows(allowed func(rule Access_rule) bool) bool {
+	if a == nil || a.rules == nil {
+		return true
+	}
+	for _, rule := range a.rules {
+		if rule.appliesTo(a.principal) && allowed(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// May the Principal register a Service with the keys?
+func (a *access) mayRegister(keys map[string]string) bool {
+	return a.allows(func(rule Access_rule) bool { return keysMatch(rule.Register, keys) })
+}
+
+// May the Principal look up a Service with the keys?
+func (a *access) mayLookup(keys map[string]string) bool {
+	return a.allows(func(rule Access_rule) bool { return keysMatch(rule.Lookup, keys) })
+}
+
+// May the Principal gossip with us?
+func (a *access) mayGossip() bool {
+	return a.allows(func(rule Access_rule) bool { return rule.Gossip })
+}
+
+// May the Principal scrape the metrics?
+func (a *access) mayScrape() bool {
+	return a.allows(func(rule Access_rule) bool { return rule.Metrics })
+}
+
+// Hides the Services that the Principal may not look up. Nil if it can see them all.
+func (a *access) visible() func(s Service) bool {
+	if a == nil || a.rules == nil {
+		return nil
+	}
+	return func(s Service) bool { return a.mayLookup(s.Keys) }
+}
+
+// Who made the request, for error messages.
+func (a *access) who() *Principal {
+	if a == nil {
+		return &Principal{Name: Anonymous_principal}
+	}
+	return a.principal
+}
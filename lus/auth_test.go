@@ -0,0 +1,146 @@
+package lus
+
+/**
+  Test that each kind of credentials is checked and that the access rules limit what a Principal can register, look up and gossip.
+**/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticators(t *testing.T) {
+	bearer := NewBearerAuthenticator([]Auth_token{{Token: "s3cret", Principal: Principal{Name: "billing-svc"}}})
+	r := httptest.NewRequest("GET", "/", nil)
+	if p, err := bearer.Authenticate(r); p != nil || err != nil {
+		t.Fatalf("Expected a request without a token to be passed over but got %v %v", p, err)
+	}
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if p, err := bearer.Authenticate(r); err != nil || p.Name != "billing-svc" {
+		t.Fatalf("Expected the token to be accepted but got %v %v", p, err)
+	}
+	r.Header.Set("Authorization", "Bearer guessed")
+	if _, err := bearer.Authenticate(r); err == nil {
+		t.Fatal("Expected an unknown token to be turned down")
+	}
+
+	signed := NewHMACAuthenticator([]Auth_key{{ID: "k1", Secret: "shh", Principal: Principal{Name: "lus2"}}})
+	sign := func(body string) *http.Request {
+		r := httptest.NewRequest("POST", "/register?x=1", strings.NewReader(body))
+		if err := SignRequest(r, "k1", "shh"); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r = sign(`{"Lease": 1000}`)
+	if p, err := signed.Authenticate(r); err != nil || p.Name != "lus2" {
+		t.Fatalf("Expected the signature to be accepted but got %v %v", p, err)
+	}
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != `{"Lease": 1000}` {
+		t.Fatalf("Expected the body to be left for the handler but got %v", string(body))
+	}
+	if _, err := signed.Authenticate(r); err == nil {
+		t.Fatal("Expected a replayed request to be turned down")
+	}
+	r = sign(`{"Lease": 1000}`)
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"Lease": 9999}`))
+	if _, err := signed.Authenticate(r); err == nil {
+		t.Fatal("Expected a tampered body to be turned down")
+	}
+	for header, tamper := range map[string]func(r *http.Request){
+		"Host":             func(r *http.Request) { r.Host = "lus2.example.com" },
+		Lease_token_header: func(r *http.Request) { r.Header.Set(Lease_token_header, "stolen") },
+		"If-Match":         func(r *http.Request) { r.Header.Set("If-Match", `"3"`) },
+		Namespace_header:   func(r *http.Request) { r.Header.Set(Namespace_header, "billing") },
+		Nonce_header:       func(r *http.Request) { r.Header.Del(Nonce_header) },
+	} {
+		r = sign("")
+		tamper(r)
+		if _, err := signed.Authenticate(r); err == nil {
+			t.Fatalf("Expected a request with a changed %v to be turned down", header)
+		}
+	}
+	r = sign("")
+	signed.(*hmac_authenticator).now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	if _, err := signed.Authenticate(r); err == nil {
+		t.Fatal("Expected an old signature to be turned down")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	if p, _ := NewCertAuthenticator().Authenticate(r); p != nil {
+		t.Fatalf("Expected a connection without a verified certificate to be passed over but got %v", p)
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "billing-svc", OrganizationalUnit: []string{"billing"}}}}}
+	if p, _ := NewCertAuthenticator().Authenticate(r); p == nil || p.Name != "billing-svc" || p.Teams[0] != "billing" {
+		t.Fatalf("Expected the principal to come from the certificate but got %v", p)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	auth := Auth_config{
+		Tokens: []Auth_token{
+			{Token: "billing-token", Principal: Principal{Name: "billing-svc", Teams: []string{"billing"}}},
+			{Token: "ops-token", Principal: Principal{Name: "dashboard", Teams: []string{"ops"}}},
+		},
+		HMACKeys: []Auth_key{{ID: "k1", Secret: "shh", Principal: Principal{Name: "lus2"}}},
+		Rules: []Access_rule{
+			{Name: "billing", Teams: []string{"billing"}, Register: map[string]string{"application": "billing*"}, Lookup: map[string]string{}},
+			{Name: "ops", Teams: []string{"ops"}, Lookup: map[string]string{"env": "prod"}},
+			{Name: "peers", Principals: []string{"lus2"}, Gossip: true},
+		},
+	}
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	server := httptest.NewServer(NewAuthHandler(test_lus_handler(t, Options{MaxLease: 60000}, urls), auth))
+	defer server.Close()
+	root := server.URL + "/"
+	ctx := context.Background()
+
+	if _, err := NewClient(ctx, root); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected a client without credentials to be turned away but got %v", err)
+	}
+	billing := must_client(t, root, WithBearerToken("billing-token"))
+	ops := must_client(t, root, WithBearerToken("ops-token"))
+
+	prod := must_register(t, billing, NewService(map[string]string{"application": "billing-api", "env": "prod"}, 10000, "", "b1"))
+	dev := must_register(t, billing, NewService(map[string]string{"application": "billing-api", "env": "dev"}, 10000, "", "b2"))
+	if _, err := billing.Register(ctx, NewService(map[string]string{"application": "payroll"}, 10000, "", "p1")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected billing to be stopped registering payroll but got %v", err)
+	}
+	if _, err := billing.ModifyAttributes(ctx, prod, ReplaceKey("application", "payroll")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected billing to be stopped modifying an entry into payroll but got %v", err)
+	}
+	if _, err := ops.Register(ctx, NewService(map[string]string{"application": "billing-api"}, 10000, "", "o1")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected ops to be stopped registering but got %v", err)
+	}
+
+	assert_num_entries("billing", must_find(t, billing, map[string]string{"application": "billing-api"}), 2)
+	found := must_find(t, ops, map[string]string{"application": "billing-api"})
+	assert_num_entries("ops", found, 1)
+	assert_id(found[0], "b1")
+	if _, err := ops.Get(ctx, dev); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ops not to be able to see the dev entry but got %v", err)
+	}
+
+	peer, _ := StartWithOptions(Options{MaxLease: 60000})
+	signed := &client_state{http_client: http.DefaultClient}
+	WithHMAC("k1", "shh")(signed)
+	if err := gossipWith(peer, signed.httpClient(), root); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("gossiped", ask(peer, Request{q: "find"}).matches, 2)
+	impostor := &client_state{http_client: http.DefaultClient}
+	WithBearerToken("billing-token")(impostor)
+	if err := gossipWith(peer, impostor.httpClient(), root); err == nil {
+		t.Fatal("Expected billing not to be allowed to gossip")
+	}
+}
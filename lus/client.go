@@ -5,33 +5,187 @@ package lus
   some kind of LookupLocator (https://river.apache.org/doc/api/net/jini/core/discovery/LookupLocator.html) and corresponding LookupDiscoveryService
   (https://river.apache.org/doc/api/net/jini/discovery/LookupDiscoveryService.html)
 
+  Every call that goes to the LUS takes a context.Context, so that it can be cancelled or given a deadline, and returns an error
+  rather than panicking. All the calls made by a Client share a single http.Client so that connections to the LUS are reused.
+
+  If the LUS needs credentials then the Client can be given a bearer token, a key to sign its requests with or a TLS client
+  certificate, which are then sent with every call. A LUS served over https with a private CA is trusted with WithRootCAs.
+
+  The Client remembers the lease token of every Registration it makes and sends it whenever that Registration's url is renewed,
+  modified or cancelled. A Registration made elsewhere can be used as long as it still has its Token.
 **/
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Every call that goes to the LUS returns an error if it can't be reached or turns the request down. See errors.go for the
+// sentinel errors that they can be checked against.
 type Client interface {
-	Register(service Service) Registration
+	Register(ctx context.Context, service Service) (Registration, error)
 	Auto_renew(registration Registration)
-	Renew(url string, lease int64) Registration
-	Find(keys map[string]string) []Service
+	Renew(ctx context.Context, url string, lease int64) (Registration, error)
+	Find(ctx context.Context, keys map[string]string) ([]Service, error)
+	FindWhere(ctx context.Context, query Query) ([]Service, error)
+	Notify(ctx context.Context, keys map[string]string, callback string, lease int64) (Registration, error)
+	Watch(ctx context.Context, keys map[string]string, index int64) (Watch_response, error)
 	Root_URL() string
+	Groups(ctx context.Context) ([]string, error)
 	Halt_renew(registration Registration)
+	Cancel(ctx context.Context, registration Registration) error
+	ModifyAttributes(ctx context.Context, registration Registration, changes ...Attribute_change) (Service, error)
+	ModifyAttributesIf(ctx context.Context, registration Registration, version int64, changes ...Attribute_change) (Service, error)
+	CancelIf(ctx context.Context, registration Registration, version int64) error
+	Get(ctx context.Context, registration Registration) (Service, error)
+	CreateRenewalSet(ctx context.Context, request Renewal_set_request) (Registration, error)
+	RenewFor(ctx context.Context, set Registration, registration Registration, duration time.Duration) error
 }
 
+// The http.Client that is used if one isn't supplied with WithHTTPClient.
+var default_http_client = &http.Client{}
+
 // Internal struct that holds the details of the LUS client
 type client_state struct {
-	root_url         string
+	root_url     string
+	http_client  *http.Client
+	lazy         bool
+	credentials  func(r *http.Request) error // Adds the credentials to every request
+	certificates []tls.Certificate           // TLS client certificates
+	root_cas     *x509.CertPool              // The CAs to verify the LUS with. The system CAs are used if nil
+
+	groups []string // Only accept a LUS in one of these groups and only register and find in them
+
+	mutex            sync.Mutex // Guards everything below
+	resolved         bool       // Have we been to the root url yet?
 	registration_url string
 	find_url         string
+	notify_url       string
+	renewal_url      string
+	lus_groups       []string          // The groups that the LUS is a member of
+	tokens           map[string]string // The lease tokens of the Registrations, by url
+
+	renewals *LeaseRenewalManager // Looks after the Registrations passed to Auto_renew
+}
+
+// An option that can be passed in to NewClient.
+type Client_option func(client *client_state)
 
-	renewals map[Registration]chan bool
+// Only accept a LUS that is a member of one of the groups. Services are registered in, and found from, just these groups.
+func WithGroups(groups ...string) Client_option {
+	return func(client *client_state) {
+		client.groups = groups
+	}
+}
+
+// Use the http.Client for every call to the LUS e.g. to set timeouts or a proxy.
+func WithHTTPClient(http_client *http.Client) Client_option {
+	return func(client *client_state) {
+		client.http_client = http_client
+	}
+}
+
+// Send the bearer token with every call.
+func WithBearerToken(token string) Client_option {
+	return func(client *client_state) {
+		client.credentials = func(r *http.Request) error {
+			r.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}
+	}
+}
+
+// Sign every call with the shared secret, see SignRequest.
+func WithHMAC(key_id string, secret string) Client_option {
+	return func(client *client_state) {
+		client.credentials = func(r *http.Request) error {
+			return SignRequest(r, key_id, secret)
+		}
+	}
+}
+
+// Present the certificate to the LUS. Only works if the http.Client uses an *http.Transport, which is the default.
+func WithClientCertificate(certificate tls.Certificate) Client_option {
+	return func(client *client_state) {
+		client.certificates = append(client.certificates, certificate)
+	}
+}
+
+// Verify the LUS against these CAs rather than the system ones e.g. the CA bundle from LoadCertPool. Only works if the http.Client
+// uses an *http.Transport, which is the default.
+func WithRootCAs(root_cas *x509.CertPool) Client_option {
+	return func(client *client_state) {
+		client.root_cas = root_cas
+	}
+}
+
+// Use a namespace on the LUS (see namespace.go) rather than the default one. The root url is still that of the LUS itself.
+func WithNamespace(name string) Client_option {
+	return func(client *client_state) {
+		client.root_url = strings.TrimSuffix(client.root_url, "/") + Namespace_path + name + "/"
+	}
+}
+
+// Wraps the http.Client so that every request carries the credentials and uses the TLS settings.
+func (client *client_state) httpClient() *http.Client {
+	if client.credentials == nil && len(client.certificates) == 0 && client.root_cas == nil {
+		return client.http_client
+	}
+	configured := *client.http_client
+	transport := configured.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if t, ok := transport.(*http.Transport); ok && (len(client.certificates) > 0 || client.root_cas != nil) {
+		t = t.Clone()
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.Certificates = append(t.TLSClientConfig.Certificates, client.certificates...)
+		if client.root_cas != nil {
+			t.TLSClientConfig.RootCAs = client.root_cas
+		}
+		transport = t
+	}
+	if client.credentials != nil {
+		transport = &credentials_transport{transport: transport, credentials: client.credentials}
+	}
+	configured.Transport = transport
+	return &configured
+}
+
+// Adds the credentials to each request on its way out.
+type credentials_transport struct {
+	transport   http.RoundTripper
+	credentials func(r *http.Request) error
+}
+
+func (t *credentials_transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context()) // A RoundTripper mustn't change the request it is given
+	err := t.credentials(r)
+	if err != nil {
+		return nil, err
+	}
+	return t.transport.RoundTrip(r)
+}
+
+// Don't go to the root url of the LUS until the first call that needs it, so that a Client can be created while the LUS is down.
+// The root url is tried again on every call until it succeeds.
+func WithLazyResolution() Client_option {
+	return func(client *client_state) {
+		client.lazy = true
+	}
 }
 
 // Represents the JSON data struct that lets clients ask to extend a lease registration.
@@ -39,183 +193,369 @@ type Renew_request struct {
 	Lease int64
 }
 
-// Initialises and returns a new Client.
-func NewClient(root_url string) *client_state {
-	// Make a call to the HATEOAS URL to find out which URLS we use for the various services
+// Initialises and returns a new Client. Unless WithLazyResolution is used this goes to the root url of the LUS straight away and
+// fails if it can't be reached or, when the client only accepts certain groups, the LUS is not a member of any of them.
+func NewClient(ctx context.Context, root_url string, options ...Client_option) (Client, error) {
+	client := &client_state{
+		root_url:    root_url,
+		http_client: default_http_client,
+		tokens:      make(map[string]string),
+	}
+	for _, option := range options {
+		option(client)
+	}
+	client.http_client = client.httpClient()
+	client.renewals = NewLeaseRenewalManager(client)
+	if client.lazy {
+		return client, nil
+	}
+	err := client.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
 
-	registration_url, find_url := get_hateoas(root_url)
+// Make a call to the HATEOAS URL to find out which URLS we use for the various services, unless we already have.
+func (client *client_state) resolve(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.resolved {
+		return nil
+	}
+	links, lus_groups, err := get_hateoas(ctx, client.http_client, client.root_url)
+	if err != nil {
+		return err
+	}
+	if len(client.groups) > 0 && !inGroups(lus_groups, client.groups) {
+		return &Error{Code: Code_not_in_groups, Message: "The LUS at " + client.root_url + " is not a member of any of the groups " + strings.Join(client.groups, ",")}
+	}
+	client.registration_url = links[Rel_register]
+	client.find_url = links[Rel_find]
+	client.notify_url = links[Rel_notify]
+	client.renewal_url = links[Rel_renewal]
+	client.lus_groups = lus_groups
+	client.resolved = true
+	return nil
+}
 
-	client := &client_state{
-		root_url:         root_url,
-		registration_url: registration_url,
-		find_url:         find_url,
-
-		renewals: make(map[Registration]chan bool),
-	}
-	return client
-}
-
-// Handle the automatic renewal of the supplied Registration
-func (client client_state) Auto_renew(registration Registration) {
-	stop_chan := make(chan bool)
-	m := client.renewals
-	m[registration] = stop_chan
-	client.renewals = m
-	go func() {
-		r := registration
-		for {
-			select {
-			case <-stop_chan:
-				return
-			default:
-				renew_freq := time.Duration(int64(r.Lease/2)) * time.Millisecond
-				time.Sleep(renew_freq)
-				r = client.Renew(r.Url, r.Lease)
-
-			}
-		}
-	}()
+// The url for a link relation, going to the root url first if need be.
+func (client *client_state) link(ctx context.Context, rel string) (string, error) {
+	err := client.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	switch rel {
+	case Rel_register:
+		return client.registration_url, nil
+	case Rel_find:
+		return client.find_url, nil
+	case Rel_renewal:
+		return client.renewal_url, nil
+	default:
+		return client.notify_url, nil
+	}
+}
+
+// Handle the automatic renewal of the supplied Registration. Renewal stops if the lease is lost; any other failure is retried.
+// Use a LeaseRenewalManager to find out when a lease is lost or to have the Service registered again.
+func (client *client_state) Auto_renew(registration Registration) {
+	client.renewals.ManageLease(registration)
 }
 
 // Stop renewing a Registration
-func (client client_state) Halt_renew(registration Registration) {
-	stop_chan, ok := client.renewals[registration]
-	if ok {
-		delete(client.renewals, registration)
-		stop_chan <- ok
+func (client *client_state) Halt_renew(registration Registration) {
+	client.renewals.Remove(registration)
+}
+
+// Is the Registration being renewed automatically?
+func (client *client_state) renewing(registration Registration) bool {
+	return client.renewals.managing(registration)
+}
+
+// Remembers the lease token of a Registration so that it is sent whenever the Registration's url is used.
+func (client *client_state) remember(registration Registration) {
+	if registration.Token == "" {
+		return
 	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.tokens[registration.Url] = registration.Token
 }
 
-// Gets the root url that defines this client.
-func (c client_state) Root_URL() string {
-	return c.root_url
+// Forgets the lease token for a url that the LUS no longer knows about.
+func (client *client_state) forget(url string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	delete(client.tokens, url)
+}
+
+// The lease token for a url, if there is one.
+func (client *client_state) token(url string) string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.tokens[url]
 }
 
-func get(url string) chan []Service {
-	response_channel := make(chan []Service)
-	go get_http(response_channel, url)
-	return response_channel
+// Gets the root url that defines this client.
+func (client *client_state) Root_URL() string {
+	return client.root_url
 }
 
-// Client interface to Renew with the LUS
-func (client client_state) Renew(url string, lease int64) Registration {
-	return <-renew_chan(url, lease)
+// Gets the groups that the LUS is a member of.
+func (client *client_state) Groups(ctx context.Context) ([]string, error) {
+	err := client.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.lus_groups, nil
 }
 
-func renew_chan(url string, lease int64) chan Registration {
-	response_channel := make(chan Registration)
-	r := Renew_request{Lease: lease}
-	go renew_http(r, response_channel, url)
-	return response_channel
+// Client interface to Renew with the LUS. Returns ErrLeaseExpired if the LUS has already dropped the registration.
+func (client *client_state) Renew(ctx context.Context, url string, lease int64) (Registration, error) {
+	registration := Registration{}
+	err := client.call(ctx, "PUT", url, Renew_request{Lease: lease}, 0, &registration)
+	if errors.Is(err, ErrLeaseExpired) {
+		client.forget(url)
+	}
+	registration.Token = client.token(url)
+	return registration, err
 }
 
 // Client interface to Register with the LUS
-func (client client_state) Register(service Service) Registration {
-	return <-register_chan(service, client.registration_url)
+// If the Service doesn't target any groups then it is registered in the groups the client was created with.
+func (client *client_state) Register(ctx context.Context, service Service) (Registration, error) {
+	if len(service.Groups) == 0 {
+		service.Groups = client.groups
+	}
+	url, err := client.link(ctx, Rel_register)
+	if err != nil {
+		return Registration{}, err
+	}
+	registration := Registration{}
+	err = client.call(ctx, "POST", url, service, 0, &registration)
+	client.remember(registration)
+	return registration, err
 }
 
-func register_chan(service Service, url string) chan Registration {
-	response_channel := make(chan Registration)
-	go register_http(service, response_channel, url)
-	return response_channel
+// Client interface to remove a Registration from the LUS straight away. Stops any automatic renewal of it first.
+// Returns ErrNotFound if the LUS didn't know about it e.g. because its lease had already run out.
+func (client *client_state) Cancel(ctx context.Context, registration Registration) error {
+	return client.CancelIf(ctx, registration, 0)
 }
 
-// Client interface to Find matching templates
-func (client client_state) Find(keys map[string]string) []Service {
-	return <-find_chan(keys, client.find_url)
+// Client interface to remove a Registration from the LUS straight away, but only if the entry is still at the version. Returns
+// a *Version_conflict if it has changed since. Stops any automatic renewal of it first.
+func (client *client_state) CancelIf(ctx context.Context, registration Registration, version int64) error {
+	client.Halt_renew(registration)
+	client.remember(registration)
+	err := client.call(ctx, "DELETE", registration.Url, nil, version, nil)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		client.forget(registration.Url)
+	}
+	return err
 }
 
-func find_chan(keys map[string]string, url string) chan []Service {
-	response_channel := make(chan []Service)
-	e := Service{Keys: keys}
-	go find_http(e, response_channel, url)
-	return response_channel
+// Client interface to change the attributes of a registered Service without re-registering it e.g.
+// ModifyAttributes(ctx, r, ReplaceKey("status", "draining"), RemoveKey("weight")). Returns the Service as it now is. The changes
+// are applied all together or not at all.
+func (client *client_state) ModifyAttributes(ctx context.Context, registration Registration, changes ...Attribute_change) (Service, error) {
+	return client.ModifyAttributesIf(ctx, registration, 0, changes...)
 }
 
-func get_http(response_channel chan []Service, url string) {
-	body := get_to_server(url)
-	response_channel <- get_entries(body)
+// As ModifyAttributes but only if the entry is still at the version (e.g. from Get or Find). Returns a *Version_conflict if it
+// has changed since. A zero version means any version will do.
+func (client *client_state) ModifyAttributesIf(ctx context.Context, registration Registration, version int64, changes ...Attribute_change) (Service, error) {
+	client.remember(registration)
+	service := Service{}
+	err := client.call(ctx, "PATCH", registration.Url, changes, version, &service)
+	return service, err
 }
 
-func renew_http(r Renew_request, response_channel chan Registration, url string) {
-	json, _ := json.Marshal(r)
-	body := json_to_server(bytes.NewBuffer(json), url, "PUT")
-	response_channel <- get_Registration(body)
+// Client interface to get the Service for a Registration as it is now, including its version.
+func (client *client_state) Get(ctx context.Context, registration Registration) (Service, error) {
+	entries := []Service{}
+	err := client.call(ctx, "GET", registration.Url, nil, 0, &entries)
+	if err == nil && len(entries) == 0 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return Service{}, err
+	}
+	return entries[0], nil
 }
 
-func register_http(service Service, response_channel chan Registration, url string) {
-	json, _ := json.Marshal(service)
-	body := json_to_server(bytes.NewBuffer(json), url, "POST")
-	response_channel <- get_Registration(body)
+// Client interface to create a renewal set on the LUS, which will keep Registrations alive after this process has gone away.
+// The set has a lease of its own which can be renewed with Renew and it can be removed with Cancel.
+func (client *client_state) CreateRenewalSet(ctx context.Context, request Renewal_set_request) (Registration, error) {
+	url, err := client.link(ctx, Rel_renewal)
+	if err != nil {
+		return Registration{}, err
+	}
+	set := Registration{}
+	err = client.call(ctx, "POST", url, request, 0, &set)
+	client.remember(set)
+	return set, err
 }
 
-func find_http(e Service, response_channel chan []Service, url string) {
-	json, _ := json.Marshal(e)
-	body := json_to_server(bytes.NewBuffer(json), url, "POST")
-	response_channel <- get_entries(body)
+// Client interface to ask a renewal set to keep the Registration alive for the duration, or for as long as the set itself is
+// kept alive if that is sooner. A zero duration takes the Registration out of the set.
+func (client *client_state) RenewFor(ctx context.Context, set Registration, registration Registration, duration time.Duration) error {
+	client.remember(set)
+	client.remember(registration)
+	member := Renewal_member_request{Url: registration.Url, Duration: inMilliseconds(duration), Token: client.token(registration.Url)}
+	return client.call(ctx, "POST", set.Url, member, 0, nil)
 }
 
-// Makes the hateoas call to the root url to get the list of other urls that will drive the application
-// Returns registration_url, find_url
-func get_hateoas(root_url string) (string, string) {
-	lr := get_link_relations(get_to_server(root_url))
+// Client interface to Find matching templates
+func (client *client_state) Find(ctx context.Context, keys map[string]string) ([]Service, error) {
+	return client.find(ctx, Find_request{Keys: keys, Groups: client.groups})
+}
+
+// Client interface to Find the Services that match a query e.g.
+// FindWhere(ctx, And(Key("env").In("prod", "staging"), Key("version").VersionAtLeast("1.2.0")))
+func (client *client_state) FindWhere(ctx context.Context, query Query) ([]Service, error) {
+	return client.find(ctx, Find_request{Groups: client.groups, Query: query.String()})
+}
 
-	// We are assuming that we only get two LinkRelations here. Dangerous!!!!
-	if lr[0].Rel == "http://rels.ewansilver.com/v1/lus/register" {
-		registration_url := lr[0].Href
-		find_url := lr[1].Href
-		return registration_url, find_url
-		return registration_url, find_url
-	} else {
-		registration_url := lr[1].Href
-		find_url := lr[0].Href
-		return registration_url, find_url
+func (client *client_state) find(ctx context.Context, e Find_request) ([]Service, error) {
+	url, err := client.link(ctx, Rel_find)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Service{}
+	err = client.call(ctx, "POST", url, e, 0, &entries)
+	return entries, err
+}
+
+// Client interface to ask the LUS to POST an Event to the callback url whenever a Service matching the keys changes
+func (client *client_state) Notify(ctx context.Context, keys map[string]string, callback string, lease int64) (Registration, error) {
+	url, err := client.link(ctx, Rel_notify)
+	if err != nil {
+		return Registration{}, err
 	}
+	registration := Registration{}
+	err = client.call(ctx, "POST", url, Notify_request{Keys: keys, Groups: client.groups, Callback: callback, Lease: lease}, 0, &registration)
+	client.remember(registration)
+	return registration, err
 }
 
-func get_link_relations(body []byte) []LinkRelation {
+// Client interface to watch for changes to matching templates. Pass in 0 to get all the current matches and then the returned
+// Index on each subsequent call. Blocks until something changes, the LUS gives up waiting or the context is done.
+func (client *client_state) Watch(ctx context.Context, keys map[string]string, index int64) (Watch_response, error) {
+	url, err := client.link(ctx, Rel_find)
+	if err != nil {
+		return Watch_response{}, err
+	}
+	response := Watch_response{}
+	err = client.call(ctx, "POST", url+"?watch=true&index="+strconv.FormatInt(index, 10), Find_request{Keys: keys, Groups: client.groups}, 0, &response)
+	return response, err
+}
+
+// Makes the hateoas call to the root url to get the list of other urls that will drive the application
+// Returns a map of link relation to url and the groups that the LUS is a member of
+func get_hateoas(ctx context.Context, http_client *http.Client, root_url string) (map[string]string, []string, error) {
 	relations := []LinkRelation{}
-	json.Unmarshal(body, &relations)
-	return relations
+	err := call(ctx, http_client, "GET", root_url, "", nil, 0, &relations)
+	if err != nil {
+		return nil, nil, err
+	}
+	links := make(map[string]string)
+	groups := []string{}
+	for _, lr := range relations {
+		if lr.Rel == Rel_group {
+			groups = append(groups, lr.Href)
+		} else {
+			links[lr.Rel] = lr.Href
+		}
+	}
+	return links, groups, nil
 }
 
-// Make a get to the URL and get a byte array of JSON back
-func get_to_server(url string) []byte {
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Set("Content-Type", "application/json")
+// Makes the call, sending the lease token for the url if we have one.
+func (client *client_state) call(ctx context.Context, method string, url string, request interface{}, version int64, result interface{}) error {
+	return call(ctx, client.http_client, method, url, client.token(url), request, version, result)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// Sends the request to the LUS as JSON (if there is one) and decodes the response into result (if there is one). A response
+// that isn't successful is returned as an *Error, or a *Version_conflict for a 412.
+func call(ctx context.Context, http_client *http.Client, method string, url string, token string, request interface{}, version int64, result interface{}) error {
+	var json_body io.Reader
+	if request != nil {
+		b, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		json_body = bytes.NewBuffer(b)
+	}
+	resp, body, err := send_to_server(ctx, http_client, json_body, url, method, token, version)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	return body
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return response_error(url, resp, body)
+	}
+	if result == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, result)
 }
 
-func json_to_server(json io.Reader, url string, method string) []byte {
-	req, err := http.NewRequest(method, url, json)
-	req.Header.Set("Content-Type", "application/json")
+// Makes the request and returns the response so that the status code and headers can be checked. If the version isn't zero
+// then it is sent as an If-Match header, and the token (if there is one) goes in the Lease-Token header.
+func send_to_server(ctx context.Context, http_client *http.Client, json io.Reader, url string, method string, token string, version int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, json)
+	if err != nil {
+		return nil, nil, err
+	}
+	if json != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if version != 0 {
+		req.Header.Set("If-Match", etagFor(version))
+	}
+	if token != "" {
+		req.Header.Set(Lease_token_header, token)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := http_client.Do(req)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	return body
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
 }
 
-func get_Registration(body []byte) Registration {
-	response := Registration{}
-	json.Unmarshal(body, &response)
-	return response
+// The codes to use when a response that isn't successful doesn't have an Error body e.g. because it came from a proxy.
+var status_codes = map[int]string{
+	http.StatusBadRequest:            Code_bad_request,
+	http.StatusForbidden:             Code_forbidden,
+	http.StatusNotFound:              Code_not_found,
+	http.StatusMethodNotAllowed:      Code_method_not_allowed,
+	http.StatusConflict:              Code_conflict,
+	http.StatusRequestEntityTooLarge: Code_too_large,
+	http.StatusUnsupportedMediaType:  Code_unsupported_media_type,
+	http.StatusTooManyRequests:       Code_too_many_requests,
 }
 
-func get_entries(body []byte) []Service {
-	entries := []Service{}
-	json.Unmarshal(body, &entries)
-	return entries
+// Turns a response that wasn't successful into an error. A 412 becomes a *Version_conflict and anything else an *Error.
+func response_error(url string, resp *http.Response, body []byte) error {
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		version, _ := versionOf(resp.Header.Get("ETag"))
+		return &Version_conflict{Url: url, Version: version}
+	}
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e = &Error{Code: status_codes[resp.StatusCode], Message: strings.TrimSpace(string(body))}
+		if e.Code == "" {
+			e.Code = Code_internal
+		}
+	}
+	e.Status = resp.StatusCode
+	return e
 }
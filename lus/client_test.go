@@ -5,6 +5,13 @@ package lus
 **/
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,22 +22,22 @@ func root_url() string { return "http://localhost:3000/" }
 func TestClient(t *testing.T) {
 	var lease int64 = 10000
 
-	client := NewClient(root_url())
+	client := must_client(t, root_url())
 	assert_strings_match("http://localhost:3000/", client.Root_URL())
 
 	// First we need to make sure that the LUS is empty
-	a := client.Find(map[string]string{"application": "poller"})
+	a := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("a", a, 0)
 
 	serviceB := NewService(map[string]string{"application": "poller", "environment": "prod", "id": "b"}, lease, "", "b123")
 	serviceC := NewService(map[string]string{"application": "poller", "environment": "dev", "id": "c"}, lease, "", "c456")
 	// Then we can register a couple of templates
-	b := client.Register(serviceB)
-	c := client.Register(serviceC)
+	b := must_register(t, client, serviceB)
+	c := must_register(t, client, serviceC)
 
 	// Make sure that calling the specific entry URL gives you the appropriate Service back.
-	bb := client.Find(map[string]string{"id": "b"})
-	cc := client.Find(map[string]string{"id": "c"})
+	bb := must_find(t, client, map[string]string{"id": "b"})
+	cc := must_find(t, client, map[string]string{"id": "c"})
 
 	assert_num_entries("bb", bb, 1)
 	b_entry := bb[0]
@@ -47,37 +54,37 @@ func TestClient(t *testing.T) {
 	assert_id(c_entry, "c456") // This should fail as we are expecting "c456"
 
 	// Then we need to make sure that both entries are present
-	d := client.Find(map[string]string{"application": "poller"})
+	d := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("d", d, 2)
 
 	// Check that we can remove one of the entries (we do this by setting its lease to zero which basically means that it gets pulled out of the LUS)
-	client.Renew(b.Url, 0)
+	client.Renew(context.Background(), b.Url, 0)
 
 	// Then we need to make sure that only one entry is present
-	e := client.Find(map[string]string{"application": "poller"})
+	e := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("e", e, 1)
 
 	// Finally renew with a zero second lease to make sure that we have removed the entry from the LUS and it does not break any other tests.
 	// Need to solve how to start up and shut down LUS services.
-	client.Renew(c.Url, 0)
+	client.Renew(context.Background(), c.Url, 0)
 
 	// Finally we check that we have cleared everything out of the lus
-	f := client.Find(map[string]string{"application": "poller"})
+	f := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("f", f, 0)
 
 }
 
 // Test the leases are capped.
 func TestCappedLease(t *testing.T) {
-	client := NewClient(root_url())
+	client := must_client(t, root_url())
 
 	// First we need to make sure that the LUS is empty
-	a := client.Find(map[string]string{"application": "poller"})
+	a := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("a", a, 0)
 
 	serviceB := NewService(map[string]string{"application": "poller", "environment": "prod", "id": "b"}, 99999999999, "", "anID")
-	b := client.Register(serviceB)
-	client.Renew(b.Url, 0)
+	b := must_register(t, client, serviceB)
+	client.Renew(context.Background(), b.Url, 0)
 	if !(b.Lease == 120000) {
 		panic("Lease was not capped.")
 	}
@@ -87,27 +94,27 @@ func TestCappedLease(t *testing.T) {
 // Test that the auto renewal function works.
 func TestAutoRenewal(t *testing.T) {
 	var lease int64 = 1000
-	client := NewClient(root_url())
+	client := must_client(t, root_url())
 
 	// First we need to make sure that the LUS is empty
-	a := client.Find(map[string]string{"application": "poller"})
+	a := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("a", a, 0)
 
 	serviceB := NewService(map[string]string{"application": "poller", "environment": "prod", "id": "b"}, lease, "", "anID")
 
-	b := client.Register(serviceB)
+	b := must_register(t, client, serviceB)
 	client.Auto_renew(b)
 	// Lets wait 5 seconds by which time the entry should have timed out. We want to make sure that it is still there and
 	// so show that it has been autorenewed
 	time.Sleep(2500 * time.Millisecond)
 
-	c := client.Find(map[string]string{"application": "poller"})
+	c := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("c", c, 1)
 	// Finally stop renew and check that everything dies out.
 	client.Halt_renew(b)
 	time.Sleep(1000 * time.Millisecond)
 
-	d := client.Find(map[string]string{"application": "poller"})
+	d := must_find(t, client, map[string]string{"application": "poller"})
 	assert_num_entries("d", d, 0)
 }
 
@@ -122,3 +129,344 @@ func assert_id(entry Service, id string) {
 		panic("assert_id does not match")
 	}
 }
+
+// Test that a watch returns the current matches and then the changes to them.
+func TestWatch(t *testing.T) {
+	client := must_client(t, root_url())
+	keys := map[string]string{"application": "watched"}
+
+	a := must_register(t, client, NewService(keys, 10000, "", "a123"))
+	reset := must_watch(t, client, keys, 0)
+	if !reset.Reset || len(reset.Deltas) != 1 || reset.Deltas[0].Type != DeltaAdded {
+		t.Fatalf("Expected a reset with one added Service but got %v", reset)
+	}
+	assert_id(reset.Deltas[0].Service, "a123")
+
+	b := must_register(t, client, NewService(keys, 10000, "", "b123"))
+	client.Renew(context.Background(), a.Url, 0)
+	changes := must_watch(t, client, keys, reset.Index)
+	if changes.Reset || len(changes.Deltas) != 2 || changes.Index <= reset.Index {
+		t.Fatalf("Expected two changes but got %v", changes)
+	}
+	if changes.Deltas[0].Type != DeltaAdded || changes.Deltas[1].Type != DeltaRemoved {
+		t.Fatalf("Changes are in the wrong order %v", changes.Deltas)
+	}
+	assert_id(changes.Deltas[0].Service, "b123")
+	assert_id(changes.Deltas[1].Service, "a123")
+
+	// A watch with nothing to report is parked until something happens.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		client.Renew(context.Background(), b.Url, 0)
+	}()
+	parked := must_watch(t, client, keys, changes.Index)
+	if len(parked.Deltas) != 1 || parked.Deltas[0].Type != DeltaRemoved {
+		t.Fatalf("Expected the parked watch to see the removal but got %v", parked)
+	}
+}
+
+// Test that cancelling a Registration removes it straight away and stops it being renewed.
+func TestCancel(t *testing.T) {
+	client := must_client(t, root_url())
+	keys := map[string]string{"application": "cancelled"}
+
+	b := must_register(t, client, NewService(keys, 1000, "", "cancel123"))
+	client.Auto_renew(b)
+	if err := client.Cancel(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("cancelled", must_find(t, client, keys), 0)
+	if client.(*client_state).renewing(b) {
+		t.Fatal("Expected the automatic renewal to have been stopped")
+	}
+	if err := client.Cancel(context.Background(), b); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the LUS to have forgotten the registration but got %v", err)
+	}
+
+	// Give a stray renewal the chance to bring it back.
+	time.Sleep(600 * time.Millisecond)
+	assert_num_entries("not renewed", must_find(t, client, keys), 0)
+
+	assert_status(t, "DELETE", root_url()+"entry/unknown", "", http.StatusNotFound)
+	assert_status(t, "POST", b.Url, "", http.StatusMethodNotAllowed)
+}
+
+// Test that the attributes of a registered Service can be changed in place and that watchers see the change.
+func TestModifyAttributes(t *testing.T) {
+	client := must_client(t, root_url())
+	keys := map[string]string{"application": "modified"}
+	r := must_register(t, client, NewService(map[string]string{"application": "modified", "status": "up", "weight": "10"}, 10000, "v1", "m123"))
+	defer client.Cancel(context.Background(), r)
+	watched := must_watch(t, client, keys, 0)
+
+	s, err := client.ModifyAttributes(context.Background(), r, ReplaceKey("status", "draining"), RemoveKey("weight"), AddKey("zone", "a"), ReplaceData("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert_contains("status", "draining", s.Keys)
+	assert_contains("zone", "a", s.Keys)
+	assert_strings_match("v2", s.Data)
+	if _, ok := s.Keys["weight"]; ok {
+		t.Fatal("Expected the weight key to have been removed")
+	}
+	found := must_find(t, client, map[string]string{"status": "draining"})
+	assert_num_entries("found", found, 1)
+	assert_id(found[0], "m123")
+	assert_num_entries("old status", must_find(t, client, map[string]string{"application": "modified", "status": "up"}), 0)
+
+	changed := must_watch(t, client, keys, watched.Index)
+	if len(changed.Deltas) != 1 || changed.Deltas[0].Type != DeltaUpdated {
+		t.Fatalf("Expected the watch to see an update but got %v", changed)
+	}
+
+	_, err = client.ModifyAttributes(context.Background(), r, ReplaceKey("status", "down"), AddKey("zone", "b"))
+	if err == nil {
+		t.Fatal("Expected adding an existing key to fail")
+	}
+	assert_num_entries("unchanged", must_find(t, client, map[string]string{"status": "draining"}), 1)
+	_, err = client.ModifyAttributes(context.Background(), Registration{Url: root_url() + "entry/unknown"}, ReplaceData("v3"))
+	if err == nil {
+		t.Fatal("Expected modifying an unknown entry to fail")
+	}
+}
+
+// Test that changes made against an old version of an entry are rejected.
+func TestVersionConflicts(t *testing.T) {
+	client := must_client(t, root_url())
+	keys := map[string]string{"application": "versioned"}
+	r := must_register(t, client, NewService(keys, 10000, "v1", "v123"))
+	defer client.Cancel(context.Background(), r)
+
+	s, err := client.Get(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert_int64(s.Version, must_find(t, client, keys)[0].Version, t)
+	modified, err := client.ModifyAttributesIf(context.Background(), r, s.Version, ReplaceData("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert_int64(modified.Version, s.Version+1, t)
+
+	_, err = client.ModifyAttributesIf(context.Background(), r, s.Version, ReplaceData("v3"))
+	conflict, ok := err.(*Version_conflict)
+	if !ok {
+		t.Fatalf("Expected a version conflict but got %v", err)
+	}
+	assert_int64(conflict.Version, modified.Version, t)
+	if err = client.CancelIf(context.Background(), r, s.Version); err == nil {
+		t.Fatal("Expected cancelling an old version to fail")
+	}
+
+	req, _ := http.NewRequest("GET", r.Url, nil)
+	req.Header.Set("If-None-Match", etagFor(modified.Version))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected 304 but got %v", resp.StatusCode)
+	}
+
+	if err = client.CancelIf(context.Background(), r, modified.Version); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("cancelled", must_find(t, client, keys), 0)
+}
+
+// Helpers that fail the test if the LUS turns the request down.
+func must_client(t *testing.T, root_url string, options ...Client_option) Client {
+	client, err := NewClient(context.Background(), root_url, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func must_register(t *testing.T, client Client, service Service) Registration {
+	registration, err := client.Register(context.Background(), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registration
+}
+
+func must_find(t *testing.T, client Client, keys map[string]string) []Service {
+	services, err := client.Find(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func must_find_where(t *testing.T, client Client, query Query) []Service {
+	services, err := client.FindWhere(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func must_watch(t *testing.T, client Client, keys map[string]string, index int64) Watch_response {
+	response, err := client.Watch(context.Background(), keys, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func must_notify(t *testing.T, client Client, keys map[string]string, callback string, lease int64) Registration {
+	registration, err := client.Notify(context.Background(), keys, callback, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registration
+}
+
+// Test that bad requests are turned down with a structured error and the right status code.
+func TestErrors(t *testing.T) {
+	client := must_client(t, root_url())
+
+	_, err := client.Register(context.Background(), NewService(map[string]string{"application": "invalid"}, -1, "", ""))
+	lus_err, ok := err.(*Error)
+	if !ok || lus_err.Status != http.StatusBadRequest || lus_err.Code != Code_bad_request || lus_err.Details["Lease"] != "-1" || !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("Expected a negative lease to be a bad request but got %#v", err)
+	}
+	_, err = client.Register(context.Background(), NewService(map[string]string{strings.Repeat("k", Max_key_size+1): "v"}, 1000, "", ""))
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("Expected a long key to be a bad request but got %v", err)
+	}
+	_, err = client.Renew(context.Background(), root_url()+"entry/unknown", 1000)
+	if !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("Expected renewing an unknown entry to be a lost lease but got %v", err)
+	}
+	_, err = client.Get(context.Background(), Registration{Url: root_url() + "entry/unknown"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected getting an unknown entry to be not found but got %v", err)
+	}
+
+	assert_status(t, "POST", root_url()+"register", "{", http.StatusBadRequest)
+	assert_status(t, "GET", root_url()+"register", "", http.StatusMethodNotAllowed)
+	assert_status(t, "POST", root_url()+"find", `{"Query": "has ("}`, http.StatusBadRequest)
+	assert_status(t, "POST", root_url()+"register", `{"Keys": {"big": "`+strings.Repeat("x", Max_body_size)+`"}}`, http.StatusRequestEntityTooLarge)
+
+	req, _ := http.NewRequest("POST", root_url()+"register", strings.NewReader("application=poller"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON 415 but got %v %v", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+// Check the status code that the LUS sends back for a request.
+func assert_status(t *testing.T, method string, url string, body string, status int) {
+	resp, _, err := send_to_server(context.Background(), http.DefaultClient, strings.NewReader(body), url, method, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("Expected %v for %v %v but got %v", status, method, url, resp.StatusCode)
+	}
+}
+
+// Counts the requests that go through it.
+type counting_transport struct {
+	count int32
+}
+
+func (c *counting_transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.count, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Test that calls can be cancelled, that the supplied http.Client is used and that resolution of the root url can be left until later.
+func TestClientContextAndOptions(t *testing.T) {
+	down := "http://" + free_tcp_addr(t) + "/"
+	if _, err := NewClient(context.Background(), down); err == nil {
+		t.Fatal("Expected NewClient to fail when the LUS is down")
+	}
+	lazy, err := NewClient(context.Background(), down, WithLazyResolution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lazy.Find(context.Background(), map[string]string{"application": "lazy"}); err == nil {
+		t.Fatal("Expected a call to fail while the LUS is down")
+	}
+
+	transport := &counting_transport{}
+	client := must_client(t, start_test_lus(t, Options{MaxLease: 60000}), WithHTTPClient(&http.Client{Transport: transport}))
+	keys := map[string]string{"application": "context"}
+	index := must_watch(t, client, keys, 0).Index
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Watch(ctx, keys, index)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("Expected the watch to be cancelled by the deadline but got %v after %v", err, time.Since(start))
+	}
+	if atomic.LoadInt32(&transport.count) != 3 {
+		t.Fatalf("Expected the root url, a watch and a cancelled watch to use the http.Client but it saw %v requests", transport.count)
+	}
+}
+
+// Test that a parked watch comes back as soon as its wait runs out and that a watch whose client goes away gives up its place.
+func TestWatchWait(t *testing.T) {
+	SetLimits(Limits{MaxWatches: 1})
+	defer SetLimits(Default_limits)
+	root := start_test_lus(t, Options{MaxLease: 60000})
+	client := must_client(t, root)
+	keys := map[string]string{"application": "waited"}
+	index := must_watch(t, client, keys, 0).Index
+
+	watch := func(ctx context.Context, wait string) (*http.Response, error) {
+		r, _ := http.NewRequestWithContext(ctx, "POST", root+"find?watch=true&wait="+wait+"&index="+strconv.FormatInt(index, 10), strings.NewReader(`{"Keys": {"application": "waited"}}`))
+		return http.DefaultClient.Do(r)
+	}
+	start := time.Now()
+	resp, err := watch(context.Background(), "50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Expected the watch to come back after its wait but got %v after %v", resp.StatusCode, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = watch(ctx, "30s")
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the watch to be parked until it was cancelled but got %v", err)
+	}
+	for i := 0; ; i++ { // Turned away while the cancelled watch is still parked, which is only until the LUS notices
+		resp, err = watch(context.Background(), "10ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Expected the cancelled watches to have given up their place but got %v", resp.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// An address that nothing is listening on.
+func free_tcp_addr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
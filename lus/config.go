@@ -0,0 +1,411 @@
+package lus
+
+/**
+  Configuration for the LUS server. Settings come from, in increasing order of precedence, the defaults, a JSON config file,
+  GOLUS_* environment variables and finally any command line flags that were given e.g.
+
+      {
+          "Listen": "10.0.0.5:3000",
+          "BaseURL": "http://lus.example.com/",
+          "TrustedProxies": ["10.0.0.0/8"],
+          "MaxLease": 120000,
+          "PolicyFile": "/etc/golus/policy.json",
+          "Store": {"Type": "file", "Dir": "/var/lib/golus"},
+          "Groups": ["prod"],
+          "Peers": ["http://lus2.example.com/"],
+          "Limits": {"MaxBodySize": 65536, "MaxWatches": 1000},
+          "TLS": {"Cert": "/etc/golus/cert.pem", "Key": "/etc/golus/key.pem", "ClientCA": "/etc/golus/ca.pem"},
+          "Log": {"File": "/var/log/golus.log", "Requests": true},
+          "Auth": {"Tokens": [{"Token": "s3cret", "Name": "billing-svc", "Teams": ["billing"]}], "Rules": [...]},
+          "Namespaces": [{"Name": "billing", "MaxEntries": 500, "MaxDataSize": 4096, "Rules": [...]}],
+          "MetricsKey": "application"
+      }
+
+  The whole configuration is validated before anything is started so that a mistake is reported up front rather than when
+  it is first used. The lease policy, the limits, the logging and the auth settings, along with the MaxLease, Policy and Rules of
+  each namespace, can be changed without a restart by sending the server a SIGHUP; anything else that has changed (including
+  adding or removing a namespace) is reported as needing a restart.
+**/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the environment variables that override the config file.
+const Env_prefix = "GOLUS_"
+
+// The settings for the LUS server.
+type Config struct {
+	Listen         string        // The address to listen on e.g. ":3000" or "10.0.0.5:3000"
+	BaseURL        string        // The url that clients reach the LUS on. If empty it is worked out from each request (see urls.go)
+	PathPrefix     string        // The path to serve the LUS under e.g. /lus
+	TrustedProxies []string      // IP addresses or CIDR ranges of proxies whose X-Forwarded-* and Forwarded headers are believed
+	MaxLease       int64         // Maximum lease time that will be handed out in ms
+	Policy         *Lease_policy `json:",omitempty"` // The lease policy. Can't be used with PolicyFile
+	PolicyFile     string        // A JSON file holding the lease policy
+	Store          Store_config
+	Node           string   // Name of this LUS. Must be unique amongst its peers. Defaults to <hostname>:<port>
+	Groups         []string // Groups this LUS is a member of
+	Peers          []string // Root urls of other LUS instances to federate with
+	GossipInterval int64    // How often to gossip with the peers in ms
+	Announce       int64    // How often to announce this LUS over multicast in ms. 0 disables announcements
+	AnnounceAddr   string   // Address that announcements are sent to
+	RequestAddr    string   // Address that discovery requests are listened for on
+	TLS            TLS_config
+	Limits         Limits
+	Log            Log_config
+	Auth           Auth_config
+	Namespaces     []Namespace_config // Registries of their own that are served under /ns/{name}/ (see namespace.go)
+	MetricsKey     string             // Break the live entries in /metrics down by the value of this key e.g. application
+}
+
+// Where registrations are persisted.
+type Store_config struct {
+	Type string // "memory" or "file"
+	Dir  string // The directory for a file store
+}
+
+// The certificate and key to serve https with. Both or neither must be given. The files are reloaded when they change.
+type TLS_config struct {
+	Cert              string
+	Key               string
+	ClientCA          string // PEM file of the CAs that client certificates are verified against
+	RequireClientCert bool   // Turn away connections without a client certificate. Otherwise they are only checked if they are sent
+	PeerCA            string // PEM file of the CAs that the peers are verified against. The system CAs are used if empty
+	ReloadInterval    int64  // How often to check the files for changes in ms. 0 only reloads them on a SIGHUP
+}
+
+// Where the log goes and what is logged.
+type Log_config struct {
+	File     string // Appended to. The log goes to stderr if empty
+	Requests bool   // Log every request that is made
+}
+
+// Who can use the LUS and what they can do. See auth.go.
+type Auth_config struct {
+	Tokens      []Auth_token  // Static bearer tokens
+	HMACKeys    []Auth_key    // Shared secrets for signed requests
+	ClientCerts bool          // Accept TLS client certificates that have been verified against the TLS ClientCA
+	Anonymous   bool          // Let requests without any credentials in as the anonymous principal
+	Rules       []Access_rule // Who may register, look up, gossip and scrape what. Without any, an authenticated principal may do anything
+	PeerToken   string        // The bearer token to send when gossiping with the peers
+}
+
+// Have any credentials been set up? If not then every request is anonymous.
+func (auth Auth_config) Enabled() bool {
+	return len(auth.Tokens) > 0 || len(auth.HMACKeys) > 0 || auth.ClientCerts
+}
+
+// The settings that can be changed with a SIGHUP. Everything else needs a restart.
+var reloadable_settings = map[string]bool{"MaxLease": true, "Policy": true, "PolicyFile": true, "Limits": true, "Log": true, "Auth": true}
+
+// The settings that are used if nothing else is given.
+func DefaultConfig() Config {
+	return Config{
+		Listen:         ":3000",
+		MaxLease:       120000,
+		Store:          Store_config{Type: "memory"},
+		GossipInterval: 1000,
+		AnnounceAddr:   Default_announce_addr,
+		RequestAddr:    Default_request_addr,
+		Limits:         Default_limits,
+		TLS:            TLS_config{ReloadInterval: 60000},
+	}
+}
+
+// Reads the config file (if there is one) over the defaults and then applies any GOLUS_* variables from the environment,
+// which is in the form returned by os.Environ. The result still needs to be validated.
+func LoadConfig(file string, environ []string) (Config, error) {
+	config := DefaultConfig()
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return config, errors.New("config: " + err.Error())
+		}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+		if err != nil {
+			return config, errors.New("config: " + file + ": " + err.Error())
+		}
+	}
+	return config, config.applyEnvironment(environ)
+}
+
+// The environment variables and the settings they override.
+var env_settings = map[string]func(c *Config, v string) error{
+	"LISTEN":          func(c *Config, v string) error { c.Listen = v; return nil },
+	"BASE_URL":        func(c *Config, v string) error { c.BaseURL = v; return nil },
+	"PATH_PREFIX":     func(c *Config, v string) error { c.PathPrefix = v; return nil },
+	"TRUSTED_PROXIES": func(c *Config, v string) error { c.TrustedProxies = splitList(v); return nil },
+	"MAX_LEASE":       func(c *Config, v string) error { return parseInt64(v, &c.MaxLease) },
+	"POLICY_FILE":     func(c *Config, v string) error { c.PolicyFile = v; return nil },
+	"STORE":           func(c *Config, v string) error { c.Store.Type = v; return nil },
+	"DATA_DIR":        func(c *Config, v string) error { c.Store.Dir = v; return nil },
+	"NODE":            func(c *Config, v string) error { c.Node = v; return nil },
+	"GROUPS":          func(c *Config, v string) error { c.Groups = splitList(v); return nil },
+	"PEERS":           func(c *Config, v string) error { c.Peers = splitList(v); return nil },
+	"GOSSIP_INTERVAL": func(c *Config, v string) error { return parseInt64(v, &c.GossipInterval) },
+	"ANNOUNCE":        func(c *Config, v string) error { return parseInt64(v, &c.Announce) },
+	"ANNOUNCE_ADDR":   func(c *Config, v string) error { c.AnnounceAddr = v; return nil },
+	"REQUEST_ADDR":    func(c *Config, v string) error { c.RequestAddr = v; return nil },
+	"TLS_CERT":        func(c *Config, v string) error { c.TLS.Cert = v; return nil },
+	"TLS_KEY":         func(c *Config, v string) error { c.TLS.Key = v; return nil },
+	"TLS_CLIENT_CA":   func(c *Config, v string) error { c.TLS.ClientCA = v; return nil },
+	"TLS_PEER_CA":     func(c *Config, v string) error { c.TLS.PeerCA = v; return nil },
+	"PEER_TOKEN":      func(c *Config, v string) error { c.Auth.PeerToken = v; return nil },
+	"MAX_BODY_SIZE":   func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxBodySize) },
+	"MAX_KEY_SIZE":    func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxKeySize) },
+	"MAX_VALUE_SIZE":  func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxValueSize) },
+	"MAX_WATCHES":     func(c *Config, v string) error { return parseInt(v, &c.Limits.MaxWatches) },
+	"LOG_FILE":        func(c *Config, v string) error { c.Log.File = v; return nil },
+	"METRICS_KEY":     func(c *Config, v string) error { c.MetricsKey = v; return nil },
+	"LOG_REQUESTS": func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Log.Requests = b
+		return err
+	},
+	"TLS_REQUIRE_CLIENT_CERT": func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.TLS.RequireClientCert = b
+		return err
+	},
+}
+
+func (c *Config) applyEnvironment(environ []string) error {
+	var errs []error
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, Env_prefix) {
+			continue
+		}
+		apply, ok := env_settings[strings.TrimPrefix(name, Env_prefix)]
+		if !ok {
+			errs = append(errs, errors.New("config: "+name+" is not a setting"))
+			continue
+		}
+		err := apply(c, value)
+		if err != nil {
+			errs = append(errs, errors.New("config: "+name+" is not valid: "+value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseInt64(v string, setting *int64) error {
+	i, err := strconv.ParseInt(v, 10, 64)
+	*setting = i
+	return err
+}
+
+func parseInt(v string, setting *int) error {
+	i, err := strconv.Atoi(v)
+	*setting = i
+	return err
+}
+
+// A comma separated list with the blanks left out.
+func splitList(v string) []string {
+	list := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Check every setting, returning all of the problems at once.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(setting string, problem string) {
+		errs = append(errs, errors.New("config: "+setting+": "+problem))
+	}
+
+	_, port, err := net.SplitHostPort(c.Listen)
+	if p, port_err := strconv.Atoi(port); err != nil || port_err != nil || p < 0 || p > 65535 {
+		invalid("Listen", "must be a host:port to listen on e.g. :3000, not "+strconv.Quote(c.Listen))
+	}
+	if c.BaseURL != "" && !validURL(c.BaseURL) {
+		invalid("BaseURL", "must be an http or https url, not "+strconv.Quote(c.BaseURL))
+	}
+	if strings.ContainsAny(c.PathPrefix, "?#") {
+		invalid("PathPrefix", "must be a path e.g. /lus, not "+strconv.Quote(c.PathPrefix))
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			invalid("TrustedProxies", "must be IP addresses or CIDR ranges, not "+strconv.Quote(proxy))
+		}
+	}
+	if c.MaxLease <= 0 {
+		invalid("MaxLease", "must be greater than 0")
+	}
+	if c.Policy != nil && c.PolicyFile != "" {
+		invalid("Policy", "can't be given as well as a PolicyFile")
+	}
+	if _, err := c.LeasePolicy(); err != nil {
+		invalid("Policy", err.Error())
+	}
+	switch c.Store.Type {
+	case "memory":
+	case "file":
+		if c.Store.Dir == "" {
+			invalid("Store", "a file store needs a Dir")
+		}
+	default:
+		invalid("Store", "the Type must be memory or file, not "+strconv.Quote(c.Store.Type))
+	}
+	for _, peer := range c.Peers {
+		if !validURL(peer) {
+			invalid("Peers", "must be http or https urls, not "+strconv.Quote(peer))
+		}
+	}
+	if c.GossipInterval <= 0 {
+		invalid("GossipInterval", "must be greater than 0")
+	}
+	if c.Announce < 0 {
+		invalid("Announce", "can't be negative")
+	}
+	if c.Announce > 0 {
+		for setting, addr := range map[string]string{"AnnounceAddr": c.AnnounceAddr, "RequestAddr": c.RequestAddr} {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				invalid(setting, "must be a host:port, not "+strconv.Quote(addr))
+			}
+		}
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		invalid("TLS", "needs both a Cert and a Key")
+	}
+	for _, file := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA, c.TLS.PeerCA} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			invalid("TLS", err.Error())
+		}
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		invalid("TLS", "a ClientCA needs a Cert and a Key to serve https with")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCA == "" {
+		invalid("TLS", "RequireClientCert needs a ClientCA to verify the certificates against")
+	}
+	if c.TLS.ReloadInterval < 0 {
+		invalid("TLS", "the ReloadInterval can't be negative")
+	}
+	if c.Limits.MaxBodySize < 0 || c.Limits.MaxKeySize < 0 || c.Limits.MaxValueSize < 0 || c.Limits.MaxWatches < 0 {
+		invalid("Limits", "can't be negative")
+	}
+	for _, t := range c.Auth.Tokens {
+		if t.Token == "" || t.Name == "" {
+			invalid("Auth", "every token needs a Token and a Name")
+		}
+	}
+	key_ids := make(map[string]bool)
+	for _, k := range c.Auth.HMACKeys {
+		if k.ID == "" || k.Secret == "" || k.Name == "" || key_ids[k.ID] {
+			invalid("Auth", "every HMAC key needs a unique ID, a Secret and a Name")
+		}
+		key_ids[k.ID] = true
+	}
+	if c.Auth.ClientCerts && c.TLS.ClientCA == "" {
+		invalid("Auth", "ClientCerts needs a TLS ClientCA to verify the certificates against")
+	}
+	if err := validateRules(c.Auth.Rules); err != nil {
+		invalid("Auth", err.Error())
+	}
+	names := make(map[string]bool)
+	for _, ns := range c.Namespaces {
+		if !validNamespace(ns.Name) || names[ns.Name] {
+			invalid("Namespaces", "every namespace needs a unique Name of lower case letters, digits, - and _, not "+strconv.Quote(ns.Name))
+		}
+		names[ns.Name] = true
+		if ns.MaxLease < 0 || ns.MaxEntries < 0 || ns.MaxDataSize < 0 {
+			invalid("Namespaces", ns.Name+": the MaxLease, MaxEntries and MaxDataSize can't be negative")
+		}
+		if ns.Policy != nil {
+			if err := ns.Policy.Validate(); err != nil {
+				invalid("Namespaces", ns.Name+": "+err.Error())
+			}
+		}
+		if err := validateRules(ns.Rules); err != nil {
+			invalid("Namespaces", ns.Name+": "+err.Error())
+		}
+		for _, peer := range ns.Peers {
+			if !validURL(peer) {
+				invalid("Namespaces", ns.Name+": the Peers must be http or https urls, not "+strconv.Quote(peer))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// The lease policy, reading it from the PolicyFile if need be. Nil if there isn't one.
+func (c Config) LeasePolicy() (*Lease_policy, error) {
+	if c.PolicyFile != "" {
+		return LoadLeasePolicy(c.PolicyFile)
+	}
+	if c.Policy != nil {
+		return c.Policy, c.Policy.Validate()
+	}
+	return nil, nil
+}
+
+// The Advertised_urls for the settings.
+func (c Config) AdvertisedUrls() (*Advertised_urls, error) {
+	return NewAdvertisedUrls(c.BaseURL, c.PathPrefix, c.TrustedProxies)
+}
+
+// The path the LUS is served under in the form /lus, or empty for the root.
+func (c Config) Prefix() string {
+	return cleanPrefix(c.PathPrefix)
+}
+
+// The port that is being listened on.
+func (c Config) Port() int {
+	_, port, _ := net.SplitHostPort(c.Listen)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// The settings that are different in the new config but can't be changed without a restart.
+func (c Config) RestartRequired(changed Config) []string {
+	settings := []string{}
+	old_value, new_value := reflect.ValueOf(c), reflect.ValueOf(changed)
+	for i := 0; i < old_value.NumField(); i++ {
+		name := old_value.Type().Field(i).Name
+		if !reloadable_settings[name] && !reflect.DeepEqual(old_value.Field(i).Interface(), new_value.Field(i).Interface()) {
+			settings = append(settings, name)
+		}
+	}
+	if reflect.DeepEqual(withoutReloadable(c.Namespaces), withoutReloadable(changed.Namespaces)) {
+		for i, name := range settings {
+			if name == "Namespaces" {
+				settings = append(settings[:i], settings[i+1:]...)
+				break
+			}
+		}
+	}
+	return settings
+}
+
+// The namespaces without the settings that can be changed with a SIGHUP.
+func withoutReloadable(namespaces []Namespace_config) []Namespace_config {
+	stripped := make([]Namespace_config, len(namespaces))
+	for i, ns := range namespaces {
+		ns.MaxLease, ns.Policy, ns.Rules = 0, nil, nil
+		stripped[i] = ns
+	}
+	return stripped
+}
@@ -0,0 +1,114 @@
+package lus
+
+/**
+  Test that the config file, the environment and the defaults are combined and checked properly, and that the settings that
+  can be reloaded take effect straight away.
+**/
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func write_config(t *testing.T, contents string) string {
+	file := filepath.Join(t.TempDir(), "golus.json")
+	err := ioutil.WriteFile(file, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := write_config(t, `{"Listen": "127.0.0.1:4000", "MaxLease": 60000, "Groups": ["prod"], "Store": {"Type": "file", "Dir": "/tmp/golus"}}`)
+	config, err := LoadConfig(file, []string{"HOME=/root", "GOLUS_MAX_LEASE=30000", "GOLUS_PEERS=http://a:3000/, http://b:3000/", "GOLUS_LOG_REQUESTS=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != "127.0.0.1:4000" || config.Port() != 4000 || config.Store.Dir != "/tmp/golus" || config.GossipInterval != 1000 {
+		t.Fatalf("Expected the file to be read over the defaults but got %+v", config)
+	}
+	if config.MaxLease != 30000 || !reflect.DeepEqual(config.Peers, []string{"http://a:3000/", "http://b:3000/"}) || !config.Log.Requests {
+		t.Fatalf("Expected the environment to override the file but got %+v", config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(write_config(t, `{"MaxLeese": 1000}`), nil); err == nil || !strings.Contains(err.Error(), "MaxLeese") {
+		t.Fatalf("Expected an unknown setting in the file to be reported but got %v", err)
+	}
+	_, err = LoadConfig("", []string{"GOLUS_MAX_LEASE=forever", "GOLUS_COLOUR=blue"})
+	if err == nil || !strings.Contains(err.Error(), "GOLUS_MAX_LEASE") || !strings.Contains(err.Error(), "GOLUS_COLOUR") {
+		t.Fatalf("Expected both bad environment variables to be reported but got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid but got %v", err)
+	}
+	config := DefaultConfig()
+	config.Listen = "3000"
+	config.BaseURL = "lus.example.com"
+	config.MaxLease = 0
+	config.Store = Store_config{Type: "file"}
+	config.Peers = []string{"ftp://peer"}
+	config.TLS = TLS_config{Cert: "cert.pem"}
+	config.Policy = &Lease_policy{Min: 2000, Max: 1000}
+	config.TrustedProxies = []string{"proxy.example.com"}
+	config.Auth = Auth_config{ClientCerts: true, Tokens: []Auth_token{{Token: "s3cret"}}}
+	config.Namespaces = []Namespace_config{{Name: "billing"}, {Name: "billing"}, {Name: "../etc"}}
+	err := config.Validate()
+	for _, setting := range []string{"Listen", "BaseURL", "MaxLease", "Store", "Peers", "TLS", "Policy", "TrustedProxies", "Auth", "Namespaces"} {
+		if err == nil || !strings.Contains(err.Error(), "config: "+setting+":") {
+			t.Fatalf("Expected %v to be reported but got %v", setting, err)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	config := DefaultConfig()
+	reloaded := DefaultConfig()
+	reloaded.MaxLease = 1000
+	reloaded.Limits.MaxWatches = 10
+	reloaded.Log.Requests = true
+	if restart := config.RestartRequired(reloaded); len(restart) != 0 {
+		t.Fatalf("Expected the changes to be applied without a restart but got %v", restart)
+	}
+	config.Namespaces = []Namespace_config{{Name: "billing", MaxLease: 60000}}
+	reloaded.Namespaces = []Namespace_config{{Name: "billing", MaxLease: 30000, Policy: &Lease_policy{Max: 10000}, Rules: []Access_rule{}}}
+	if restart := config.RestartRequired(reloaded); len(restart) != 0 {
+		t.Fatalf("Expected the namespace's leases and rules to be changed without a restart but got %v", restart)
+	}
+	reloaded.Listen = ":4000"
+	reloaded.Groups = []string{"prod"}
+	reloaded.Namespaces = append(reloaded.Namespaces, Namespace_config{Name: "ops"})
+	if restart := config.RestartRequired(reloaded); !reflect.DeepEqual(restart, []string{"Listen", "Groups", "Namespaces"}) {
+		t.Fatalf("Expected the listen address, groups and namespaces to need a restart but got %v", restart)
+	}
+	if options := reloaded.Namespaces[0].LeaseOptions(120000); options.MaxLease != 30000 || options.Policy.Max != 10000 {
+		t.Fatalf("Expected the namespace's own leases but got %v", options)
+	}
+	if options := reloaded.Namespaces[1].LeaseOptions(120000); options.MaxLease != 120000 || options.Policy != nil {
+		t.Fatalf("Expected the LUS's maximum lease but got %v", options)
+	}
+}
+
+func TestReloadableSettings(t *testing.T) {
+	t.Cleanup(func() { SetLimits(Default_limits) })
+	SetLimits(Limits{MaxKeySize: 4})
+	if validateKey("long key", "") == nil || validateKey("key", strings.Repeat("v", Max_value_size)) != nil {
+		t.Fatal("Expected only the key size to have changed")
+	}
+
+	c, _ := StartWithOptions(Options{MaxLease: 60000})
+	Reconfigure(c, Options{MaxLease: 1000})
+	r := ask(c, Request{q: "register", service: NewService(nil, 60000, "", "")})
+	if r.lease != 1000 {
+		t.Fatalf("Expected the new maximum lease to be used but got %v", r.lease)
+	}
+}
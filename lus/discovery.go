@@ -0,0 +1,269 @@
+package lus
+
+/**
+  Multicast discovery of LUS instances, loosely following the Jini multicast announcement and request protocols. An Announcer
+  runs alongside the LUS and periodically sends its root url and groups to the announcement address. It also listens on the
+  request address and answers any discovery request (for one of its groups) by sending an announcement straight back to the
+  requester. A Discoverer listens for announcements, sends a discovery request when it starts so that it doesn't have to wait
+  for the next announcement, and reports every LUS it discovers, or discards, on a chan.
+
+  Both addresses are normally multicast groups but any UDP address will do e.g. 127.0.0.1:4160 for testing on loopback.
+**/
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The addresses used by Jini for the multicast announcement and request protocols.
+const (
+	Default_announce_addr = "224.0.1.84:4160"
+	Default_request_addr  = "224.0.1.85:4160"
+)
+
+// The largest packet we expect to send or receive.
+const max_packet_size = 8192
+
+// Represents the JSON data struct that is sent over UDP. Announcements carry the root url of the LUS and the groups it is a member
+// of. Requests have no Url and carry the groups the requester is interested in.
+type Discovery_packet struct {
+	Url    string `json:",omitempty"`
+	Groups []string
+}
+
+// Reports that a LUS has been discovered or, if Discarded is true, that it has gone away.
+type Discovery_event struct {
+	Url       string
+	Groups    []string
+	Discarded bool
+}
+
+// Announces a LUS on the network.
+type Announcer struct {
+	announcement []byte
+	announce     *net.UDPAddr
+	groups       []string
+	requests     *net.UDPConn
+	conn         *net.UDPConn
+	stop         chan bool
+}
+
+// Start announcing the root url of a LUS every interval and answering discovery requests.
+func StartAnnouncer(root_url string, groups []string, announce_addr string, request_addr string, interval time.Duration) (*Announcer, error) {
+	announce, err := net.ResolveUDPAddr("udp4", announce_addr)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := listenUDP(request_addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		requests.Close()
+		return nil, err
+	}
+	announcement, _ := json.Marshal(Discovery_packet{Url: root_url, Groups: groups})
+	a := &Announcer{announcement: announcement, announce: announce, groups: groups, requests: requests, conn: conn, stop: make(chan bool)}
+	go a.answerRequests()
+	go a.announceEvery(interval)
+	return a, nil
+}
+
+// Stop announcing.
+func (a *Announcer) Close() {
+	close(a.stop)
+	a.requests.Close()
+	a.conn.Close()
+}
+
+func (a *Announcer) announceEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.conn.WriteToUDP(a.announcement, a.announce)
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Announcer) answerRequests() {
+	buf := make([]byte, max_packet_size)
+	for {
+		n, from, err := a.requests.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+		var request Discovery_packet
+		if json.Unmarshal(buf[:n], &request) != nil {
+			continue
+		}
+		if inGroups(a.groups, request.Groups) {
+			a.conn.WriteToUDP(a.announcement, from)
+		}
+	}
+}
+
+// Discovers LUS instances on the network.
+type Discoverer struct {
+	groups        []string
+	discard_after time.Duration
+	events        chan Discovery_event
+	announcements *net.UDPConn
+	conn          *net.UDPConn
+	stop          chan bool
+
+	mutex     sync.Mutex
+	last_seen map[string]time.Time
+}
+
+// Start discovering LUS instances that are members of any of the groups (or every LUS if no groups are supplied). A LUS that
+// hasn't been heard from for discard_after is discarded, unless discard_after is 0 (or less) in which case nothing is. The chan
+// returned by Events must be read from or discovery will stall.
+func NewDiscoverer(announce_addr string, request_addr string, groups []string, discard_after time.Duration) (*Discoverer, error) {
+	announcements, err := listenUDP(announce_addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		announcements.Close()
+		return nil, err
+	}
+	d := &Discoverer{
+		groups:        groups,
+		discard_after: discard_after,
+		events:        make(chan Discovery_event, 16),
+		announcements: announcements,
+		conn:          conn,
+		stop:          make(chan bool),
+		last_seen:     make(map[string]time.Time),
+	}
+	go d.listen(announcements)
+	go d.listen(conn)
+	if discard_after > 0 {
+		go d.discardStale()
+	}
+
+	request, _ := json.Marshal(Discovery_packet{Groups: groups})
+	to, err := net.ResolveUDPAddr("udp4", request_addr)
+	if err == nil {
+		_, err = conn.WriteToUDP(request, to)
+	}
+	if err != nil {
+		log.Println("Unable to send discovery request:", err)
+	}
+	return d, nil
+}
+
+// The chan that discovered and discarded LUS instances are reported on.
+func (d *Discoverer) Events() <-chan Discovery_event {
+	return d.events
+}
+
+// Discard a LUS e.g. because it can't be reached. It will be discovered again when it next announces itself.
+func (d *Discoverer) Discard(url string) {
+	d.mutex.Lock()
+	_, ok := d.last_seen[url]
+	delete(d.last_seen, url)
+	d.mutex.Unlock()
+	if ok {
+		d.report(Discovery_event{Url: url, Discarded: true})
+	}
+}
+
+// Stop discovering.
+func (d *Discoverer) Close() {
+	close(d.stop)
+	d.announcements.Close()
+	d.conn.Close()
+}
+
+func (d *Discoverer) listen(conn *net.UDPConn) {
+	buf := make([]byte, max_packet_size)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+		var announcement Discovery_packet
+		if json.Unmarshal(buf[:n], &announcement) != nil || announcement.Url == "" || !inGroups(announcement.Groups, d.groups) {
+			continue
+		}
+		d.mutex.Lock()
+		_, known := d.last_seen[announcement.Url]
+		d.last_seen[announcement.Url] = time.Now()
+		d.mutex.Unlock()
+		if !known {
+			d.report(Discovery_event{Url: announcement.Url, Groups: announcement.Groups})
+		}
+	}
+}
+
+func (d *Discoverer) discardStale() {
+	interval := d.discard_after / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			stale := []string{}
+			d.mutex.Lock()
+			for url, seen := range d.last_seen {
+				if now.Sub(seen) > d.discard_after {
+					stale = append(stale, url)
+					delete(d.last_seen, url)
+				}
+			}
+			d.mutex.Unlock()
+			for _, url := range stale {
+				d.report(Discovery_event{Url: url, Discarded: true})
+			}
+		}
+	}
+}
+
+func (d *Discoverer) report(e Discovery_event) {
+	select {
+	case d.events <- e:
+	case <-d.stop:
+	}
+}
+
+// Listen on the address, joining the group if it is a multicast address.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	udp_addr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	if udp_addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", nil, udp_addr)
+	}
+	return net.ListenUDP("udp4", udp_addr)
+}
+
+// Is there any overlap between the groups a LUS is a member of and the groups that are wanted? Wanting no groups means any LUS will do.
+func inGroups(member_of []string, wanted []string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		for _, m := range member_of {
+			if w == m {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package lus
+
+/**
+  Test the discovery protocols on loopback.
+**/
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	announce_addr, request_addr := free_udp_addr(t), free_udp_addr(t)
+
+	// Announce rarely so that the first discovery has to come from the answer to our request.
+	announcer, err := StartAnnouncer("http://localhost:3000/", []string{"prod"}, announce_addr, request_addr, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discoverer, err := NewDiscoverer(announce_addr, request_addr, []string{"prod"}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discoverer.Close()
+
+	discovered := wait_for_discovery(t, discoverer)
+	if discovered.Discarded || discovered.Url != "http://localhost:3000/" {
+		t.Fatalf("Expected to discover the LUS but got %v", discovered)
+	}
+
+	announcer.Close()
+	discarded := wait_for_discovery(t, discoverer)
+	if !discarded.Discarded || discarded.Url != "http://localhost:3000/" {
+		t.Fatalf("Expected the LUS to be discarded but got %v", discarded)
+	}
+}
+
+// Test that a Discoverer that never discards anything (or discards almost straight away) can be started.
+func TestDiscardAfter(t *testing.T) {
+	for _, discard_after := range []time.Duration{0, -time.Second, time.Nanosecond} {
+		discoverer, err := NewDiscoverer(free_udp_addr(t), free_udp_addr(t), nil, discard_after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		discoverer.Close()
+	}
+}
+
+func TestInGroups(t *testing.T) {
+	if !inGroups([]string{"prod"}, nil) || !inGroups([]string{"dev", "prod"}, []string{"prod"}) || inGroups([]string{"dev"}, []string{"prod"}) {
+		t.Fatal("inGroups is broken")
+	}
+}
+
+func wait_for_discovery(t *testing.T, d *Discoverer) Discovery_event {
+	select {
+	case e := <-d.Events():
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for discovery")
+	}
+	return Discovery_event{}
+}
+
+// Find a free loopback UDP address.
+func free_udp_addr(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
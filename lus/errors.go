@@ -0,0 +1,258 @@
+package lus
+
+/**
+  The error model shared by the LUS and the Client. Every request that fails gets a JSON Error body with a machine readable Code,
+  a Message for people and any Details that help pin down what was wrong, along with a status code that matches. The Client
+  turns these back into an *Error that can be checked against the sentinel errors with errors.Is e.g.
+
+      _, err := client.Renew(registration.Url, 10000)
+      if errors.Is(err, lus.ErrLeaseExpired) {
+          // Register again
+      }
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// The codes that can be sent in an Error.
+const (
+	Code_bad_request            = "bad_request"
+	Code_not_found              = "not_found"
+	Code_lease_expired          = "lease_expired"
+	Code_method_not_allowed     = "method_not_allowed"
+	Code_conflict               = "conflict"
+	Code_version_conflict       = "version_conflict"
+	Code_too_large              = "request_too_large"
+	Code_unsupported_media_type = "unsupported_media_type"
+	Code_too_many_requests      = "too_many_requests"
+	Code_forbidden              = "forbidden"
+	Code_unauthorized           = "unauthorized"
+	Code_quota_exceeded         = "quota_exceeded"
+	Code_internal               = "internal_error"
+	Code_not_in_groups          = "not_in_groups" // Only used by the Client
+)
+
+// The default limits on what a client can send us.
+const (
+	Max_body_size  = 1 << 20 // Bytes
+	Max_key_size   = 256
+	Max_value_size = 4096
+)
+
+// Limits on what clients can do. They can be changed while the LUS is running with SetLimits.
+type Limits struct {
+	MaxBodySize  int // Bytes
+	MaxKeySize   int
+	MaxValueSize int
+	MaxWatches   int // How many watches can be parked at once
+}
+
+// The limits that are used until SetLimits is called.
+var Default_limits = Limits{MaxBodySize: Max_body_size, MaxKeySize: Max_key_size, MaxValueSize: Max_value_size, MaxWatches: max_waiting_watches}
+
+var current_limits atomic.Pointer[Limits]
+
+// Change the limits on what clients can do. Any limit that is 0 goes back to its default.
+func SetLimits(limits Limits) {
+	if limits.MaxBodySize == 0 {
+		limits.MaxBodySize = Default_limits.MaxBodySize
+	}
+	if limits.MaxKeySize == 0 {
+		limits.MaxKeySize = Default_limits.MaxKeySize
+	}
+	if limits.MaxValueSize == 0 {
+		limits.MaxValueSize = Default_limits.MaxValueSize
+	}
+	if limits.MaxWatches == 0 {
+		limits.MaxWatches = Default_limits.MaxWatches
+	}
+	current_limits.Store(&limits)
+}
+
+func currentLimits() Limits {
+	limits := current_limits.Load()
+	if limits == nil {
+		return Default_limits
+	}
+	return *limits
+}
+
+// The sentinel errors that an *Error from the Client can be checked against with errors.Is.
+var (
+	ErrBadRequest      = errors.New("lus: bad request")
+	ErrNotFound        = errors.New("lus: not found")
+	ErrLeaseExpired    = errors.New("lus: lease expired")
+	ErrConflict        = errors.New("lus: conflict")
+	ErrVersionConflict = errors.New("lus: version conflict")
+	ErrTooLarge        = errors.New("lus: request too large")
+	ErrTooManyRequests = errors.New("lus: too many requests")
+	ErrForbidden       = errors.New("lus: forbidden")
+	ErrUnauthorized    = errors.New("lus: unauthorized")
+	ErrQuotaExceeded   = errors.New("lus: quota exceeded")
+	ErrInternal        = errors.New("lus: internal error")
+	ErrNotInGroups     = errors.New("lus: not a member of the groups")
+)
+
+var sentinel_errors = map[string]error{
+	Code_bad_request:            ErrBadRequest,
+	Code_not_found:              ErrNotFound,
+	Code_lease_expired:          ErrLeaseExpired,
+	Code_method_not_allowed:     ErrBadRequest,
+	Code_conflict:               ErrConflict,
+	Code_version_conflict:       ErrVersionConflict,
+	Code_too_large:              ErrTooLarge,
+	Code_unsupported_media_type: ErrBadRequest,
+	Code_too_many_requests:      ErrTooManyRequests,
+	Code_forbidden:              ErrForbidden,
+	Code_unauthorized:           ErrUnauthorized,
+	Code_quota_exceeded:         ErrQuotaExceeded,
+	Code_internal:               ErrInternal,
+	Code_not_in_groups:          ErrNotInGroups,
+}
+
+// Represents the JSON data struct that is sent back when a request fails. It is also the error that the Client returns.
+type Error struct {
+	Status  int `json:"-"` // The HTTP status code
+	Code    string
+	Message string
+	Details map[string]string `json:",omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "lus: " + e.Message + " (" + e.Code + ")"
+}
+
+// Allows errors.Is to match an *Error against the sentinel error for its Code.
+func (e *Error) Is(target error) bool {
+	return sentinel_errors[e.Code] == target
+}
+
+func newError(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// Add a detail to the error.
+func (e *Error) with(key string, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+func badRequest(message string) *Error {
+	return newError(http.StatusBadRequest, Code_bad_request, message)
+}
+
+func notFound(id string) *Error {
+	return newError(http.StatusNotFound, Code_not_found, "There is no such entry").with("ID", id)
+}
+
+// The lease token that was sent doesn't match the one handed out with the Registration.
+func forbidden(id string) *Error {
+	return newError(http.StatusForbidden, Code_forbidden, "The "+Lease_token_header+" is missing or wrong").with("ID", id)
+}
+
+// Tell the client which methods it can use.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, newError(http.StatusMethodNotAllowed, Code_method_not_allowed, "Method not allowed").with("Allow", allowed))
+}
+
+// Send the error to the client.
+func writeError(w http.ResponseWriter, e *Error) {
+	b, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	w.Write(b)
+}
+
+// Deferred by the handlers so that anything unexpected becomes a 500 rather than a dropped connection.
+func recoverErrors(w http.ResponseWriter) {
+	v := recover()
+	if v != nil {
+		log.Println("Recovered from:", v)
+		writeError(w, newError(http.StatusInternalServerError, Code_internal, "Something went wrong"))
+	}
+}
+
+// Read the JSON body of the request into v, checking its content type and size.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) *Error {
+	content_type := r.Header.Get("Content-Type")
+	if content_type != "" {
+		media_type, _, err := mime.ParseMediaType(content_type)
+		if err != nil || media_type != "application/json" {
+			return newError(http.StatusUnsupportedMediaType, Code_unsupported_media_type, "Requests must be application/json").with("Content-Type", content_type)
+		}
+	}
+	limit := currentLimits().MaxBodySize
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	if err != nil {
+		var too_large *http.MaxBytesError
+		if errors.As(err, &too_large) {
+			return newError(http.StatusRequestEntityTooLarge, Code_too_large, "The request is too large").with("Limit", strconv.Itoa(limit))
+		}
+		return badRequest(err.Error())
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return badRequest("The request is not valid JSON: " + err.Error())
+	}
+	return nil
+}
+
+// Check that a lease makes sense.
+func validateLease(lease int64) *Error {
+	if lease < 0 {
+		return badRequest("The Lease can't be negative").with("Lease", strconv.FormatInt(lease, 10))
+	}
+	return nil
+}
+
+// Check that a callback is somewhere that events can be POSTed to, which has to be an absolute http or https url.
+func validateCallback(callback string) *Error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badRequest("The Callback must be an absolute http or https url").with("Callback", callback)
+	}
+	return nil
+}
+
+// Check that a key and its value are within the limits.
+func validateKey(key string, value string) *Error {
+	limits := currentLimits()
+	switch {
+	case key == "":
+		return badRequest("Keys can't be empty")
+	case len(key) > limits.MaxKeySize:
+		return badRequest("The key is too long").with("Key", key[:limits.MaxKeySize]).with("Limit", strconv.Itoa(limits.MaxKeySize))
+	case len(value) > limits.MaxValueSize:
+		return badRequest("The value is too long").with("Key", key).with("Limit", strconv.Itoa(limits.MaxValueSize))
+	}
+	return nil
+}
+
+// Check that a Service that is being registered makes sense.
+func validateService(s Service) *Error {
+	err := validateLease(s.Lease)
+	if err != nil {
+		return err
+	}
+	for k, v := range s.Keys {
+		err = validateKey(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package lus
+
+/**
+  Optimistic concurrency on entries. Every entry has a version that goes up whenever it changes (including when its lease is
+  renewed) and it is sent as the ETag of the entry url. A client that wants to be sure it isn't clobbering someone else's change
+  sends the version it last saw in an If-Match header on a PUT, PATCH or DELETE and gets a 412 if the entry has moved on since.
+  A GET with an If-None-Match header gets a 304 if the entry hasn't changed.
+**/
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Returned by the Client when an entry has changed since the version it was expecting.
+type Version_conflict struct {
+	Url     string
+	Version int64 // The version the entry is at now, if the LUS told us
+}
+
+func (e *Version_conflict) Error() string {
+	return "lus: version conflict: " + e.Url + " is now at version " + strconv.FormatInt(e.Version, 10)
+}
+
+// Allows errors.Is to match a *Version_conflict against ErrVersionConflict.
+func (e *Version_conflict) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// The ETag for a version of an entry.
+func etagFor(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// The version in an ETag. Returns false if it isn't one of ours.
+func versionOf(etag string) (int64, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// The version a client expects the entry to be at from its If-Match header. No header, or "*", gives 0 which matches any version.
+// An ETag that isn't one of ours gives -1 which matches none.
+func expectedVersion(r *http.Request) int64 {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0
+	}
+	version, ok := versionOf(header)
+	if !ok {
+		return -1
+	}
+	return version
+}
+
+// Does the entry match the version the client expects? A zero version means the client doesn't mind.
+func versionMatches(e entry_state, version int64) bool {
+	return version == 0 || e.version == version
+}
+
+// Does the If-None-Match header on a GET say that the client already has this version?
+func notModified(r *http.Request, version int64) bool {
+	for _, etag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v, ok := versionOf(etag)
+		if strings.TrimSpace(etag) == "*" || (ok && v == version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell the client that the entry has moved on from the version it expected.
+func preconditionFailed(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", etagFor(version))
+	writeError(w, newError(http.StatusPreconditionFailed, Code_version_conflict, "The entry has changed").with("Version", strconv.FormatInt(version, 10)))
+}
@@ -0,0 +1,34 @@
+package lus
+
+/**
+  Test that ETags and the conditional request headers are understood.
+**/
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConditionalHeaders(t *testing.T) {
+	for etag, expected := range map[string]int64{`"12"`: 12, `W/"7"`: 7, `12`: 0, `"abc"`: 0, `"-1"`: 0} {
+		version, _ := versionOf(etag)
+		assert_int64(version, expected, t)
+	}
+
+	r, _ := http.NewRequest("PUT", "/entry/a", nil)
+	assert_int64(expectedVersion(r), 0, t)
+	r.Header.Set("If-Match", "*")
+	assert_int64(expectedVersion(r), 0, t)
+	r.Header.Set("If-Match", `"3"`)
+	assert_int64(expectedVersion(r), 3, t)
+	r.Header.Set("If-Match", "nonsense")
+	assert_int64(expectedVersion(r), -1, t)
+	if versionMatches(entry_state{version: 3}, -1) || !versionMatches(entry_state{version: 3}, 0) {
+		t.Fatal("Expected an unknown ETag to match nothing and no ETag to match anything")
+	}
+
+	r.Header.Set("If-None-Match", `"1", "4"`)
+	if !notModified(r, 4) || notModified(r, 5) {
+		t.Fatal("If-None-Match was not honoured")
+	}
+}
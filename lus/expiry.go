@@ -0,0 +1,114 @@
+package lus
+
+/**
+  Lease expiry scheduling. Every entry has a place in a min-heap ordered by its expiry time and the lus goroutine keeps a single
+  timer set for the top of the heap, so an entry is removed as soon as its lease is up and the work done is proportional to the
+  number of leases that actually end rather than to the number of entries. Renewing a lease just moves the entry down the heap.
+**/
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Internal struct for a single lease in the heap.
+type expiry_item struct {
+	id     string
+	expiry time.Time
+}
+
+// A min-heap of leases that also tracks where each ID is so that it can be moved or removed when the lease is renewed or cancelled.
+type expiry_heap struct {
+	items     []expiry_item
+	positions map[string]int
+}
+
+func newExpiryHeap() *expiry_heap {
+	return &expiry_heap{positions: make(map[string]int)}
+}
+
+// Implementation of heap.Interface. Use schedule, unschedule and due rather than calling these directly.
+func (h *expiry_heap) Len() int           { return len(h.items) }
+func (h *expiry_heap) Less(i, j int) bool { return h.items[i].expiry.Before(h.items[j].expiry) }
+func (h *expiry_heap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.positions[h.items[i].id] = i
+	h.positions[h.items[j].id] = j
+}
+func (h *expiry_heap) Push(x interface{}) {
+	item := x.(expiry_item)
+	h.positions[item.id] = len(h.items)
+	h.items = append(h.items, item)
+}
+func (h *expiry_heap) Pop() interface{} {
+	last := len(h.items) - 1
+	item := h.items[last]
+	h.items = h.items[:last]
+	delete(h.positions, item.id)
+	return item
+}
+
+// Add a lease to the heap or move it if the ID is already there.
+func (h *expiry_heap) schedule(id string, expiry time.Time) {
+	i, ok := h.positions[id]
+	if ok {
+		h.items[i].expiry = expiry
+		heap.Fix(h, i)
+		return
+	}
+	heap.Push(h, expiry_item{id: id, expiry: expiry})
+}
+
+// Take a lease out of the heap. Does nothing if the ID isn't there.
+func (h *expiry_heap) unschedule(id string) {
+	i, ok := h.positions[id]
+	if ok {
+		heap.Remove(h, i)
+	}
+}
+
+// When the next lease is up. Returns false if there are no leases.
+func (h *expiry_heap) next() (time.Time, bool) {
+	if len(h.items) == 0 {
+		return time.Time{}, false
+	}
+	return h.items[0].expiry, true
+}
+
+// Take every lease that is up by now out of the heap and return their IDs.
+func (h *expiry_heap) due(now time.Time) []string {
+	ids := []string{}
+	for len(h.items) > 0 && !now.Before(h.items[0].expiry) {
+		ids = append(ids, heap.Pop(h).(expiry_item).id)
+	}
+	return ids
+}
+
+// A timer that goes off when the lease at the top of the heap is up. It is only replaced when the top of the heap changes.
+type expiry_timer struct {
+	timer *time.Timer
+	at    time.Time
+}
+
+// The chan that fires when the next lease is up, or nil (which blocks forever in a select) if there are no leases.
+func (t *expiry_timer) wait(h *expiry_heap) <-chan time.Time {
+	at, ok := h.next()
+	if !ok {
+		t.stop()
+		return nil
+	}
+	if t.timer == nil || !at.Equal(t.at) {
+		t.stop()
+		t.timer = time.NewTimer(time.Until(at))
+		t.at = at
+	}
+	return t.timer.C
+}
+
+// Stop the timer. It will be started again by the next call to wait.
+func (t *expiry_timer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,88 @@
+package lus
+
+/**
+  Test that leases are expired in order, that renewals move them, and compare the cost of the expiry heap with a full sweep.
+**/
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiryFollowsRenewals(t *testing.T) {
+	now := time.Now()
+	reg := newRegistry(make(map[string]entry_state), NewMemoryStore())
+	reg.put("x", entry_state{service: Service{ID: "x"}, expiry: now.Add(1 * time.Second), version: 1})
+	reg.put("y", entry_state{service: Service{ID: "y"}, expiry: now.Add(2 * time.Second), version: 1})
+	reg.put("z", entry_state{service: Service{ID: "z"}, expiry: now.Add(4 * time.Second), version: 1})
+	reg.put("x", entry_state{service: Service{ID: "x"}, expiry: now.Add(3 * time.Second), version: 2})
+	reg.cancel("z")
+
+	next, _ := reg.expiries.next()
+	if !next.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("Expected the next expiry to be y but got %v", next.Sub(now))
+	}
+	reg.expire(now.Add(2500 * time.Millisecond))
+	if len(reg.entries) != 1 || reg.entries["x"].version != 2 {
+		t.Fatalf("Expected only the renewed entry to be left but got %v", reg.entries)
+	}
+	reg.expire(now.Add(3 * time.Second))
+	if len(reg.entries) != 0 || reg.expiries.Len() != 0 {
+		t.Fatalf("Expected everything to have expired but got %v", reg.entries)
+	}
+}
+
+func TestLeaseEndsOnTime(t *testing.T) {
+	c, _ := StartWithOptions(Options{MaxLease: 60000, Node: "expiry"})
+	start := time.Now()
+	ask(c, Request{q: "register", service: NewService(map[string]string{"application": "short lived"}, 200, "", "")})
+
+	for len(ask(c, Request{q: "digest"}).versions) > 0 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("The lease never ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if time.Since(start) > 700*time.Millisecond {
+		t.Fatalf("Expected the entry to be removed shortly after 200ms but it took %v", time.Since(start))
+	}
+}
+
+// Simulates one second of expiries on a registry of 100k entries, 100 of which come to the end of their lease each second and
+// are registered again. Only the expiry is timed.
+func benchmark_expiry(b *testing.B, expire func(reg *registry, now time.Time)) {
+	const entries, slots = 100000, 1000
+	reg := newRegistry(make(map[string]entry_state), NewMemoryStore())
+	base := time.Now()
+	for i := 0; i < entries; i++ {
+		id := fmt.Sprint(i)
+		reg.put(id, entry_state{service: Service{ID: id}, expiry: base.Add(time.Duration(i%slots+1) * time.Second), version: 1})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now := base.Add(time.Duration(i+1) * time.Second)
+		expire(reg, now)
+		b.StopTimer()
+		for j := (i % slots); j < entries; j += slots {
+			id := fmt.Sprint(j)
+			reg.put(id, entry_state{service: Service{ID: id}, expiry: now.Add(slots * time.Second), version: 1})
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkExpiryHeap100k(b *testing.B) {
+	benchmark_expiry(b, func(reg *registry, now time.Time) { reg.expire(now) })
+}
+
+// The full sweep of the entries that used to be done every second, for comparison.
+func BenchmarkExpirySweep100k(b *testing.B) {
+	benchmark_expiry(b, func(reg *registry, now time.Time) {
+		for id, e := range reg.entries {
+			if !now.Before(e.expiry) {
+				reg.remove(id, e)
+			}
+		}
+	})
+}
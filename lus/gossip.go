@@ -0,0 +1,156 @@
+package lus
+
+/**
+  Anti-entropy gossip between federated LUS peers. Every interval each node POSTs a digest (entry ID -> version) of everything it
+  knows to each of its peers and the peer replies with every entry (or tombstone) that it holds a newer version of. Those are then
+  merged into the local entries, so a registration made on one node becomes findable on its peers within one gossip interval.
+
+  Leases are still honoured everywhere: every copy carries its absolute expiry time and is expired locally by each node, a copy
+  that has already expired is never merged, and a copy that is older than a tombstone or a newer local version is ignored. This
+  does assume that the clocks on the peers are roughly in sync.
+**/
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Represents the JSON data struct that a node sends to a peer to find out what it is missing.
+type Gossip_request struct {
+	Versions map[string]int64
+}
+
+// Represents the JSON data struct for a single entry that a peer has a newer version of. If Removed is true then the entry has
+// been cancelled and Expiry is when the tombstone can be forgotten.
+type Gossip_entry struct {
+	ID      string
+	Version int64
+	Expiry  time.Time
+	Service Service
+	Removed bool
+	Token   string `json:",omitempty"` // Hash of the lease token, so that the entry can be renewed on any peer
+}
+
+// The versions of every entry and tombstone that we know about.
+func (reg *registry) digest() map[string]int64 {
+	versions := make(map[string]int64, len(reg.entries)+len(reg.tombstones))
+	for id, e := range reg.entries {
+		versions[id] = e.version
+	}
+	for id, t := range reg.tombstones {
+		versions[id] = t.version
+	}
+	return versions
+}
+
+// Everything we hold that is newer than the versions a peer has sent us. Tombstones are only sent for entries the peer still has.
+func (reg *registry) newerThan(versions map[string]int64) []Gossip_entry {
+	gossip := []Gossip_entry{}
+	for id, e := range reg.entries {
+		if e.version > versions[id] {
+			gossip = append(gossip, Gossip_entry{ID: id, Version: e.version, Expiry: e.expiry, Service: e.service, Token: e.token})
+		}
+	}
+	for id, t := range reg.tombstones {
+		v, ok := versions[id]
+		if ok && t.version > v {
+			gossip = append(gossip, Gossip_entry{ID: id, Version: t.version, Expiry: t.until, Removed: true})
+		}
+	}
+	return gossip
+}
+
+// Merge a single entry from a peer, ignoring it if we already have something at least as new or it has already expired.
+func (reg *registry) merge(g Gossip_entry, now time.Time) {
+	e, ok := reg.entries[g.ID]
+	t, tomb := reg.tombstones[g.ID]
+	if g.Removed {
+		if !tomb || t.version < g.Version {
+			reg.tombstones[g.ID] = tombstone{version: g.Version, until: g.Expiry}
+		}
+		if ok && e.version < g.Version {
+			reg.remove(g.ID, e)
+		}
+		return
+	}
+	if !now.Before(g.Expiry) || (tomb && t.version >= g.Version) {
+		return
+	}
+	if ok && (e.version > g.Version || (e.version == g.Version && !g.Expiry.After(e.expiry))) {
+		return
+	}
+	reg.put(g.ID, entry_state{service: g.Service, expiry: g.Expiry, version: g.Version, token: g.Token})
+}
+
+// Wrapper func that is called when a peer POSTs its digest to us.
+func Gossip(request_channel chan Request, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	if access := accessFor(r); !access.mayGossip() {
+		writeError(w, notAllowed(access.who(), "Not allowed to gossip"))
+		return
+	}
+	var g Gossip_request
+	err := readJSON(w, r, &g)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response_chan := make(chan response)
+	request_channel <- Request{q: "gossip", response_channel: response_chan, versions: g.Versions}
+	response := <-response_chan
+	b, _ := json.Marshal(response.gossip)
+	w.Write(b)
+}
+
+// Start gossiping with the peers (supplied as root urls e.g. http://host:3000/) every interval. The options give the credentials
+// (e.g. WithBearerToken), CAs or http.Client to gossip with.
+func StartGossip(request_channel chan Request, peers []string, interval time.Duration, options ...Client_option) {
+	gossiper := &client_state{http_client: &http.Client{Timeout: interval}}
+	for _, option := range options {
+		option(gossiper)
+	}
+	go func() {
+		client := gossiper.httpClient()
+		for range time.Tick(interval) {
+			for _, peer := range peers {
+				err := gossipWith(request_channel, client, peer)
+				if err != nil {
+					log.Println("Unable to gossip with peer:", peer, err)
+				}
+			}
+		}
+	}()
+}
+
+// A single round of gossip with a peer.
+func gossipWith(request_channel chan Request, client *http.Client, peer string) error {
+	response_chan := make(chan response)
+	request_channel <- Request{q: "digest", response_channel: response_chan}
+	digest := <-response_chan
+
+	b, _ := json.Marshal(Gossip_request{Versions: digest.versions})
+	resp, err := client.Post(strings.TrimSuffix(peer, "/")+Gossip_url(), "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var gossip []Gossip_entry
+	err = json.NewDecoder(resp.Body).Decode(&gossip)
+	if err != nil {
+		return err
+	}
+	if len(gossip) > 0 {
+		request_channel <- Request{q: "merge", response_channel: response_chan, gossip: gossip}
+		<-response_chan
+	}
+	return nil
+}
+
+// Helper func to allow us to replace the gossip url easily.
+func Gossip_url() string {
+	return "/gossip"
+}
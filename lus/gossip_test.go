@@ -0,0 +1,63 @@
+package lus
+
+/**
+  Test that federated peers converge and that stale copies never bring back a cancelled or expired registration.
+**/
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGossipBetweenPeers(t *testing.T) {
+	a, _ := StartWithOptions(Options{MaxLease: 60000, Node: "a"})
+	b, _ := StartWithOptions(Options{MaxLease: 60000, Node: "b"})
+	peer_a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { Gossip(a, w, r) }))
+	defer peer_a.Close()
+
+	keys := map[string]string{"application": "gossiped"}
+	registered := ask(a, Request{q: "register", service: NewService(keys, 10000, "", "g123")})
+	ask(b, Request{q: "register", service: NewService(keys, 10000, "", "local")})
+
+	err := gossipWith(b, http.DefaultClient, peer_a.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := ask(b, Request{q: "find", service: Service{Keys: keys}}).matches
+	assert_num_entries("found", found, 2)
+
+	ask(a, Request{q: "renew", id: registered.id, service: Service{Lease: 0}, token: registered.token})
+	gossipWith(b, http.DefaultClient, peer_a.URL)
+	found = ask(b, Request{q: "find", service: Service{Keys: keys}}).matches
+	assert_num_entries("cancelled", found, 1)
+	assert_id(found[0], "local")
+}
+
+func TestMergeIgnoresStaleCopies(t *testing.T) {
+	now := time.Now()
+	reg := newRegistry(make(map[string]entry_state), NewMemoryStore())
+	reg.put("a", entry_state{service: Service{ID: "a"}, expiry: now.Add(time.Minute), version: 2})
+	reg.cancel("a")
+
+	reg.merge(Gossip_entry{ID: "a", Version: 2, Expiry: now.Add(time.Minute), Service: Service{ID: "a"}}, now)
+	reg.merge(Gossip_entry{ID: "b", Version: 5, Expiry: now.Add(-time.Second), Service: Service{ID: "b"}}, now)
+	if len(reg.entries) != 0 {
+		t.Fatalf("Stale copies were merged: %v", reg.entries)
+	}
+
+	reg.merge(Gossip_entry{ID: "c", Version: 1, Expiry: now.Add(time.Minute), Service: Service{ID: "c"}}, now)
+	reg.merge(Gossip_entry{ID: "c", Version: 3, Expiry: now.Add(2 * time.Minute), Service: Service{ID: "c", Data: "newer"}}, now)
+	reg.merge(Gossip_entry{ID: "c", Version: 2, Expiry: now.Add(3 * time.Minute), Service: Service{ID: "c", Data: "older"}}, now)
+	if reg.entries["c"].service.Data != "newer" || reg.entries["c"].version != 3 {
+		t.Fatalf("Expected the newest version to win but got %v", reg.entries["c"])
+	}
+}
+
+// Send a request straight to a lus goroutine and wait for the response.
+func ask(c chan Request, r Request) response {
+	r.response_channel = make(chan response, 1)
+	c <- r
+	return <-r.response_channel
+}
@@ -0,0 +1,53 @@
+package lus
+
+/**
+  Test that registrations and lookups are scoped to groups.
+**/
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	root := start_test_lus(t, Options{MaxLease: 60000, Groups: []string{"prod", "dev"}})
+	keys := map[string]string{"application": "grouped"}
+
+	prod := must_client(t, root, WithGroups("prod"))
+	dev := must_client(t, root, WithGroups("dev"))
+	everyone := must_client(t, root)
+	if groups, err := everyone.Groups(context.Background()); err != nil || len(groups) != 2 {
+		t.Fatalf("Expected the LUS to advertise two groups but got %v %v", groups, err)
+	}
+
+	must_register(t, prod, NewService(keys, 10000, "", "p123"))
+	must_register(t, dev, NewService(keys, 10000, "", "d123"))
+	must_register(t, everyone, NewService(keys, 10000, "", "e123"))
+
+	assert_num_entries("prod", must_find(t, prod, keys), 2)
+	assert_num_entries("dev", must_find(t, dev, keys), 2)
+	assert_num_entries("everyone", must_find(t, everyone, keys), 3)
+
+	s := NewService(keys, 10000, "", "s123")
+	s.Groups = []string{"staging"}
+	if _, err := everyone.Register(context.Background(), s); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("Registration in a group the LUS is not a member of was accepted: %v", err)
+	}
+}
+
+func TestClientRejectsLUSInOtherGroups(t *testing.T) {
+	root := start_test_lus(t, Options{MaxLease: 60000, Groups: []string{"dev"}})
+	_, err := NewClient(context.Background(), root, WithGroups("prod"))
+	if !errors.Is(err, ErrNotInGroups) {
+		t.Fatalf("Expected NewClient to reject the LUS but got %v", err)
+	}
+
+	lazy, err := NewClient(context.Background(), root, WithGroups("prod"), WithLazyResolution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lazy.Find(context.Background(), map[string]string{"application": "grouped"}); !errors.Is(err, ErrNotInGroups) {
+		t.Fatalf("Expected the lazy client to reject the LUS on first use but got %v", err)
+	}
+}
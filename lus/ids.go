@@ -0,0 +1,87 @@
+package lus
+
+/**
+  The IDs for entries, listeners and renewal sets end up in the urls that are handed out, so they must not be guessable. Each one
+  is a millisecond timestamp followed by 80 random bits from crypto/rand, written in Crockford's base32 so that (like a ULID) they
+  sort by when they were created. When the LUS has a node name it goes on the front so that federated peers can never hand out
+  the same ID and it is obvious where a registration was made.
+
+  Knowing the url isn't enough to change a registration though. Each one also gets a secret lease token that is only handed back
+  in the Registration when it is created and which has to be sent in the Lease-Token header to renew, modify or cancel it. Only a
+  hash of the token is kept, stored and gossiped to peers, so it can't be read back out of the LUS.
+**/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// The header that the lease token is sent in.
+const Lease_token_header = "Lease-Token"
+
+// Crockford's base32, which leaves out the letters that are easily confused with digits and sorts in the same order as the bits.
+var id_encoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// Creates a new random ID, prefixed with the node name if there is one e.g. lus1-06BQ8F4ZK3M0V8XJ5E7Y2N1R9C
+func newID(node string, now time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixMilli())<<16)
+	randomBytes(b[6:])
+	id := id_encoding.EncodeToString(b[:])
+	if node == "" {
+		return id
+	}
+	return nodePrefix(node) + "-" + id
+}
+
+// The node name with anything that doesn't belong in a url path replaced e.g. host:3000 becomes host-3000
+func nodePrefix(node string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, node)
+}
+
+// Returns the next unused ID. A clash is all but impossible but IDs recovered from the store or gossiped by peers are checked anyway.
+func nextUniqueID(node string, reg *registry) string {
+	for {
+		id := newID(node, time.Now())
+		if !reg.inUse(id) {
+			return id
+		}
+	}
+}
+
+// Creates a new secret lease token.
+func newToken() string {
+	b := make([]byte, 32)
+	randomBytes(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The hash of a lease token, which is all that the LUS keeps.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Does the token match the hash? Registrations without a hash (e.g. recovered from a store written before there were lease tokens)
+// can't be changed by anyone and will just run out their leases.
+func tokenMatches(hash string, token string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1
+}
+
+// Fills b from crypto/rand. There is nothing sensible to do if the operating system can't give us random numbers.
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic("lus: unable to read random bytes: " + err.Error())
+	}
+}
@@ -0,0 +1,75 @@
+package lus
+
+/**
+  Test that IDs can't be guessed and that only the holder of a lease token can change a registration.
+**/
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewID(t *testing.T) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newID("", now)
+		if len(id) != 26 || seen[id] {
+			t.Fatalf("Expected a new 26 character ID but got %v", id)
+		}
+		seen[id] = true
+	}
+	if earlier, later := newID("", now), newID("", now.Add(time.Millisecond)); earlier >= later {
+		t.Fatalf("Expected %v to sort before %v", earlier, later)
+	}
+	if id := newID("lus.example.com:3000", now); !strings.HasPrefix(id, "lus.example.com-3000-") {
+		t.Fatalf("Expected the node to be the prefix but got %v", id)
+	}
+	token := newToken()
+	if !tokenMatches(hashToken(token), token) || tokenMatches(hashToken(token), newToken()) || tokenMatches("", "") {
+		t.Fatal("Expected only the right token to match")
+	}
+}
+
+func TestLeaseTokens(t *testing.T) {
+	root := start_test_lus(t, Options{MaxLease: 60000})
+	owner := must_client(t, root)
+	other := must_client(t, root)
+	ctx := context.Background()
+
+	r := must_register(t, owner, NewService(map[string]string{"application": "tokens"}, 10000, "", "tokens123"))
+	if r.Token == "" {
+		t.Fatal("Expected a lease token with the Registration")
+	}
+	stolen := Registration{Url: r.Url, Lease: r.Lease}
+	if _, err := other.Renew(ctx, r.Url, 10000); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a renewal without the token to be forbidden but got %v", err)
+	}
+	if _, err := other.ModifyAttributes(ctx, stolen, ReplaceKey("application", "hijacked")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a modification without the token to be forbidden but got %v", err)
+	}
+	if err := other.Cancel(ctx, Registration{Url: r.Url, Token: newToken()}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a cancel with the wrong token to be forbidden but got %v", err)
+	}
+	set, err := other.CreateRenewalSet(ctx, Renewal_set_request{Lease: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RenewFor(ctx, set, stolen, time.Minute); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a renewal set to be refused an entry without its token but got %v", err)
+	}
+	if err := owner.RenewFor(ctx, Registration{Url: set.Url}, r, time.Minute); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected a renewal set to be refused without its own token but got %v", err)
+	}
+
+	renewed, err := owner.Renew(ctx, r.Url, 10000)
+	if err != nil || renewed.Token != r.Token {
+		t.Fatalf("Expected the owner to be able to renew and keep the token but got %v %v", renewed, err)
+	}
+	if err := other.Cancel(ctx, r); err != nil {
+		t.Fatalf("Expected anyone with the token to be able to cancel but got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package lus
+
+/**
+  An inverted index from key/value pairs to the IDs of the entries that have them. It is kept up to date by the registry as entries
+  come and go so that a find only has to look at the entries that have every key/value pair in the template, rather than
+  filtering the whole entries map once per key.
+**/
+
+import (
+	"sort"
+)
+
+// Internal type for the index: key -> value -> set of entry IDs.
+type attribute_index map[string]map[string]map[string]struct{}
+
+// Index the keys of an entry.
+func (idx attribute_index) add(id string, keys map[string]string) {
+	for k, v := range keys {
+		values, ok := idx[k]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			idx[k] = values
+		}
+		ids, ok := values[v]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[v] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// Remove the keys of an entry from the index, tidying up anything that is left empty.
+func (idx attribute_index) remove(id string, keys map[string]string) {
+	for k, v := range keys {
+		ids := idx[k][v]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(idx[k], v)
+			if len(idx[k]) == 0 {
+				delete(idx, k)
+			}
+		}
+	}
+}
+
+// The IDs of the entries that have every one of the key/value pairs. The posting lists are intersected starting with the smallest.
+func (idx attribute_index) lookup(keys map[string]string) []string {
+	postings := make([]map[string]struct{}, 0, len(keys))
+	for k, v := range keys {
+		ids := idx[k][v]
+		if len(ids) == 0 {
+			return nil
+		}
+		postings = append(postings, ids)
+	}
+	sort.Slice(postings, func(i, j int) bool { return len(postings[i]) < len(postings[j]) })
+
+	matches := make([]string, 0, len(postings[0]))
+outer:
+	for id := range postings[0] {
+		for _, ids := range postings[1:] {
+			if _, ok := ids[id]; !ok {
+				continue outer
+			}
+		}
+		matches = append(matches, id)
+	}
+	return matches
+}
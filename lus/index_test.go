@@ -0,0 +1,74 @@
+package lus
+
+/**
+  Test that the attribute index follows the entries as they change and benchmark find against a large registry.
+**/
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIndexFollowsEntries(t *testing.T) {
+	expiry := time.Now().Add(time.Minute)
+	reg := newRegistry(map[string]entry_state{
+		"recovered": {service: Service{ID: "recovered", Keys: map[string]string{"application": "a"}}, expiry: expiry},
+	}, NewMemoryStore())
+	reg.put("x", entry_state{service: Service{ID: "x", Keys: map[string]string{"application": "a", "env": "prod"}}, expiry: expiry, version: 1})
+	reg.put("y", entry_state{service: Service{ID: "y", Keys: map[string]string{"application": "a", "env": "test"}}, expiry: expiry, version: 1})
+
+	assert_num_entries("application", reg.find(template{keys: map[string]string{"application": "a"}}), 3)
+	assert_num_entries("prod", reg.find(template{keys: map[string]string{"application": "a", "env": "prod"}}), 1)
+	assert_num_entries("unknown", reg.find(template{keys: map[string]string{"application": "a", "env": "dev"}}), 0)
+
+	reg.put("x", entry_state{service: Service{ID: "x", Keys: map[string]string{"application": "a", "env": "dev"}}, expiry: expiry, version: 2})
+	assert_num_entries("modified from", reg.find(template{keys: map[string]string{"env": "prod"}}), 0)
+	assert_num_entries("modified to", reg.find(template{keys: map[string]string{"env": "dev"}}), 1)
+
+	reg.cancel("x")
+	reg.tick(expiry)
+	if len(reg.index) != 0 {
+		t.Fatalf("Expected the index to be empty but got %v", reg.index)
+	}
+}
+
+// A registry with n entries spread over 100 applications and 3 environments.
+func benchmark_registry(n int) *registry {
+	reg := newRegistry(make(map[string]entry_state), NewMemoryStore())
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprint(i)
+		keys := map[string]string{"application": fmt.Sprint("app-", i%100), "env": fmt.Sprint("env-", i%3), "instance": id}
+		reg.put(id, entry_state{service: Service{ID: id, Keys: keys}, expiry: expiry, version: 1})
+	}
+	return reg
+}
+
+func BenchmarkFind100k(b *testing.B) {
+	reg := benchmark_registry(100000)
+	t := template{keys: map[string]string{"application": "app-42", "env": "env-1"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reg.find(t)
+	}
+}
+
+func BenchmarkFindOne100k(b *testing.B) {
+	reg := benchmark_registry(100000)
+	t := template{keys: map[string]string{"env": "env-2", "instance": "99999"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reg.find(t)
+	}
+}
+
+// The same lookup as BenchmarkFind100k without the index, for comparison.
+func BenchmarkScan100k(b *testing.B) {
+	reg := benchmark_registry(100000)
+	t := template{keys: map[string]string{"application": "app-42", "env": "env-1"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		convertToServices(filterBy(func(e entry_state) bool { return matchesTemplate(t, e) }, reg.entries))
+	}
+}
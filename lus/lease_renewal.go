@@ -0,0 +1,354 @@
+package lus
+
+/**
+  A LeaseRenewalManager is loosely based on the Jini LeaseRenewalManager
+  (https://river.apache.org/doc/api/net/jini/lease/LeaseRenewalManager.html). It keeps any number of Registrations alive by
+  renewing each of them part way through its lease, with a little jitter so that a provider with many leases doesn't renew them
+  all at once. Every renewal asks for the lease that was asked for in the first place, so a lease the LUS cut short while it was
+  busy goes back to its full length once it isn't. A lease that is granted for 0 can't be kept alive (asking for 0 again would
+  cancel it) so it is given up on straight away with a LeaseLost event. A renewal that fails is retried with an exponential backoff for as long as the lease might still be alive. If the
+  LUS has forgotten a Registration (or the lease runs out before a renewal gets through) then a LeaseLost event is sent and, if
+  the manager knows the Service, it is registered again and a LeaseRecovered event is sent with the new Registration.
+
+      manager := lus.NewLeaseRenewalManager(client)
+      defer manager.Close()
+      registration, err := manager.Register(ctx, service)
+      ...
+      for event := range manager.Events() {
+          log.Println(event.Type, event.Url)
+      }
+**/
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The types of Lease_event.
+const (
+	LeaseLost      = "lease_lost"      // The LUS has dropped the Registration
+	LeaseRecovered = "lease_recovered" // The Service has been registered again after its lease was lost
+)
+
+// Defaults for a LeaseRenewalManager.
+const (
+	default_renew_fraction = 0.5
+	default_renew_jitter   = 0.1
+	default_min_backoff    = 100 * time.Millisecond
+	default_max_backoff    = 10 * time.Second
+	renewal_events_size    = 64
+	renewal_close_timeout  = 5 * time.Second
+)
+
+// The Err of a LeaseLost event (or the error from Register) when the LUS granted a lease of 0.
+var ErrNoLease = errors.New("lus: the lease granted was 0")
+
+// Sent by a LeaseRenewalManager when a lease it is looking after is lost or recovered.
+type Lease_event struct {
+	Type         string
+	Url          string       // The url of the Registration that was given to the manager, which identifies the lease
+	Registration Registration // The Registration as it is now. For a LeaseRecovered this is the new one
+	Err          error        // Why the lease was lost
+}
+
+// An option that can be passed in to NewLeaseRenewalManager.
+type Renewal_option func(manager *LeaseRenewalManager)
+
+// Renew each lease once this fraction (between 0 and 1) of it has gone. Defaults to a half.
+func WithRenewFraction(fraction float64) Renewal_option {
+	return func(manager *LeaseRenewalManager) {
+		manager.fraction = fraction
+	}
+}
+
+// Move each renewal earlier or later by up to this fraction of the time until it is due. Defaults to a tenth.
+func WithJitter(jitter float64) Renewal_option {
+	return func(manager *LeaseRenewalManager) {
+		manager.jitter = jitter
+	}
+}
+
+// Wait min before retrying a failed renewal or registration, doubling each time up to max.
+func WithBackoff(min time.Duration, max time.Duration) Renewal_option {
+	return func(manager *LeaseRenewalManager) {
+		manager.min_backoff = min
+		manager.max_backoff = max
+	}
+}
+
+// Keeps Registrations alive on a LUS.
+type LeaseRenewalManager struct {
+	client      Client
+	fraction    float64
+	jitter      float64
+	min_backoff time.Duration
+	max_backoff time.Duration
+	events      chan Lease_event
+
+	mutex  sync.Mutex // Guards everything below
+	leases map[string]*managed_lease
+	closed bool
+	wait   sync.WaitGroup
+}
+
+// A lease that is being renewed, keyed by the url of the Registration it started with.
+type managed_lease struct {
+	registration Registration // As it is now
+	service      Service      // Registered again if the lease is lost
+	reregister   bool
+	stop         context.CancelFunc
+	requested    int64 // The lease in ms to ask for on every renewal, however long the last one that was granted was
+}
+
+// Creates a LeaseRenewalManager that renews leases with the client.
+func NewLeaseRenewalManager(client Client, options ...Renewal_option) *LeaseRenewalManager {
+	manager := &LeaseRenewalManager{
+		client:      client,
+		fraction:    default_renew_fraction,
+		jitter:      default_renew_jitter,
+		min_backoff: default_min_backoff,
+		max_backoff: default_max_backoff,
+		events:      make(chan Lease_event, renewal_events_size),
+		leases:      make(map[string]*managed_lease),
+	}
+	for _, option := range options {
+		option(manager)
+	}
+	return manager
+}
+
+// The LeaseLost and LeaseRecovered events. Events are dropped rather than hold up renewals if they aren't read. The channel
+// is closed by Close.
+func (manager *LeaseRenewalManager) Events() <-chan Lease_event {
+	return manager.events
+}
+
+// Register the Service with the LUS and keep it registered until Close.
+func (manager *LeaseRenewalManager) Register(ctx context.Context, service Service) (Registration, error) {
+	registration, err := manager.client.Register(ctx, service)
+	if err != nil {
+		return registration, err
+	}
+	if registration.Lease <= 0 {
+		return registration, ErrNoLease
+	}
+	manager.Manage(registration, service)
+	return registration, nil
+}
+
+// Keep the Registration alive, registering the Service again if the LUS forgets it.
+func (manager *LeaseRenewalManager) Manage(registration Registration, service Service) {
+	requested := service.Lease
+	if requested <= 0 {
+		requested = registration.Lease
+	}
+	manager.add(registration, &managed_lease{registration: registration, service: service, reregister: true, requested: requested})
+}
+
+// Keep the Registration alive, but stop once the lease is lost. Each renewal asks for the lease the Registration has now.
+func (manager *LeaseRenewalManager) ManageLease(registration Registration) {
+	manager.add(registration, &managed_lease{registration: registration, requested: registration.Lease})
+}
+
+func (manager *LeaseRenewalManager) add(registration Registration, lease *managed_lease) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.closed {
+		return
+	}
+	if registration.Lease <= 0 {
+		manager.send(Lease_event{Type: LeaseLost, Url: registration.Url, Registration: registration, Err: ErrNoLease})
+		return
+	}
+	previous, ok := manager.leases[registration.Url]
+	if ok {
+		previous.stop()
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	lease.stop = stop
+	manager.leases[registration.Url] = lease
+	manager.wait.Add(1)
+	go manager.renew(ctx, registration.Url, lease)
+}
+
+// Stop renewing the Registration that was given to the manager. It is left on the LUS until its lease runs out.
+func (manager *LeaseRenewalManager) Remove(registration Registration) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	lease, ok := manager.leases[registration.Url]
+	if ok {
+		lease.stop()
+		delete(manager.leases, registration.Url)
+	}
+}
+
+// Is the Registration that was given to the manager still being renewed?
+func (manager *LeaseRenewalManager) managing(registration Registration) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	_, ok := manager.leases[registration.Url]
+	return ok
+}
+
+// Stop renewing every lease and cancel them all with the LUS. Returns the errors from any cancellations that failed.
+func (manager *LeaseRenewalManager) Close() error {
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return nil
+	}
+	manager.closed = true
+	leases := manager.leases
+	manager.leases = make(map[string]*managed_lease)
+	for _, lease := range leases {
+		lease.stop()
+	}
+	manager.mutex.Unlock()
+
+	manager.wait.Wait()
+	close(manager.events)
+
+	ctx, cancel := context.WithTimeout(context.Background(), renewal_close_timeout)
+	defer cancel()
+	var errs []error
+	for _, lease := range leases {
+		err := manager.client.Cancel(ctx, lease.registration)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Renew a single lease until it is stopped.
+func (manager *LeaseRenewalManager) renew(ctx context.Context, url string, lease *managed_lease) {
+	defer manager.wait.Done()
+	r := manager.current(lease)
+	expiry := time.Now().Add(time.Duration(r.Lease) * time.Millisecond)
+	backoff := time.Duration(0)
+	wait := manager.renewAfter(r.Lease)
+	lost := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if lost {
+			registered, err := manager.register(ctx, lease.service)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Println("Unable to register again, will try again:", url, err)
+				backoff = manager.nextBackoff(backoff)
+				wait = backoff
+				continue
+			}
+			if registered.Lease <= 0 {
+				manager.send(Lease_event{Type: LeaseLost, Url: url, Registration: registered, Err: ErrNoLease})
+				manager.forget(url, lease)
+				return
+			}
+			r, lost, backoff = registered, false, 0
+			expiry = time.Now().Add(time.Duration(r.Lease) * time.Millisecond)
+			wait = manager.renewAfter(r.Lease)
+			manager.update(lease, r)
+			manager.send(Lease_event{Type: LeaseRecovered, Url: url, Registration: r})
+			continue
+		}
+
+		renew_ctx, cancel := context.WithDeadline(ctx, expiry)
+		renewed, err := manager.client.Renew(renew_ctx, r.Url, lease.requested)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil && renewed.Lease <= 0:
+			manager.update(lease, renewed)
+			manager.send(Lease_event{Type: LeaseLost, Url: url, Registration: renewed, Err: ErrNoLease})
+			manager.forget(url, lease)
+			return
+		case err == nil:
+			r, backoff = renewed, 0
+			expiry = time.Now().Add(time.Duration(r.Lease) * time.Millisecond)
+			wait = manager.renewAfter(r.Lease)
+			manager.update(lease, r)
+		case errors.Is(err, ErrLeaseExpired) || !time.Now().Before(expiry):
+			manager.send(Lease_event{Type: LeaseLost, Url: url, Registration: r, Err: err})
+			if !lease.reregister {
+				manager.forget(url, lease)
+				return
+			}
+			lost, backoff, wait = true, 0, 0
+		default:
+			log.Println("Unable to renew, will try again:", url, err)
+			backoff = manager.nextBackoff(backoff)
+			wait = backoff
+			if until := time.Until(expiry); wait > until {
+				wait = until
+			}
+		}
+	}
+}
+
+func (manager *LeaseRenewalManager) register(ctx context.Context, service Service) (Registration, error) {
+	ctx, cancel := context.WithTimeout(ctx, manager.max_backoff)
+	defer cancel()
+	return manager.client.Register(ctx, service)
+}
+
+// How long to wait before renewing a lease of this many ms.
+func (manager *LeaseRenewalManager) renewAfter(lease int64) time.Duration {
+	wait := float64(lease) * manager.fraction * (1 + manager.jitter*(2*rand.Float64()-1))
+	after := time.Duration(wait * float64(time.Millisecond))
+	if after < manager.min_backoff {
+		return manager.min_backoff
+	}
+	return after
+}
+
+func (manager *LeaseRenewalManager) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < manager.min_backoff {
+		return manager.min_backoff
+	}
+	if backoff > manager.max_backoff {
+		return manager.max_backoff
+	}
+	return backoff
+}
+
+func (manager *LeaseRenewalManager) current(lease *managed_lease) Registration {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return lease.registration
+}
+
+func (manager *LeaseRenewalManager) update(lease *managed_lease, registration Registration) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	lease.registration = registration
+}
+
+// Stop tracking a lease that has been lost, unless it has been replaced in the meantime.
+func (manager *LeaseRenewalManager) forget(url string, lease *managed_lease) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.leases[url] == lease {
+		delete(manager.leases, url)
+	}
+}
+
+// Send an event without blocking.
+func (manager *LeaseRenewalManager) send(event Lease_event) {
+	select {
+	case manager.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,189 @@
+package lus
+
+/**
+  Test that the LeaseRenewalManager keeps leases alive, registers a Service again when the LUS forgets it and cleans up on Close.
+**/
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseRenewalManager(t *testing.T) {
+	client := must_client(t, root_url())
+	other := must_client(t, root_url())
+	keys := map[string]string{"application": "managed"}
+
+	manager := NewLeaseRenewalManager(client, WithRenewFraction(0.2), WithBackoff(10*time.Millisecond, 100*time.Millisecond))
+	a, err := manager.Register(context.Background(), NewService(keys, 1000, "", "managed123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	assert_num_entries("renewed", must_find(t, client, keys), 1)
+
+	// Cancel it behind the manager's back so that the next renewal finds it has gone.
+	if err := other.Cancel(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	lost := next_lease_event(t, manager)
+	if lost.Type != LeaseLost || lost.Url != a.Url || lost.Err == nil {
+		t.Fatalf("Expected the lease to be lost but got %v", lost)
+	}
+	recovered := next_lease_event(t, manager)
+	if recovered.Type != LeaseRecovered || recovered.Url != a.Url || recovered.Registration.Url == a.Url {
+		t.Fatalf("Expected the Service to be registered again but got %v", recovered)
+	}
+	assert_num_entries("recovered", must_find(t, client, keys), 1)
+
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("closed", must_find(t, client, keys), 0)
+	if _, open := <-manager.Events(); open {
+		t.Fatal("Expected the events to be closed")
+	}
+	manager.Manage(recovered.Registration, Service{})
+	if manager.managing(recovered.Registration) {
+		t.Fatal("Expected a closed manager to ignore new leases")
+	}
+}
+
+func TestLeaseLostWithoutService(t *testing.T) {
+	client := must_client(t, root_url())
+	manager := NewLeaseRenewalManager(client, WithRenewFraction(0.1))
+	defer manager.Close()
+
+	unknown := Registration{Url: root_url() + "entry/unknown", Lease: 1000}
+	manager.ManageLease(unknown)
+	lost := next_lease_event(t, manager)
+	if lost.Type != LeaseLost {
+		t.Fatalf("Expected the lease to be lost but got %v", lost)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if manager.managing(unknown) {
+		t.Fatal("Expected the manager to have stopped renewing a lost lease")
+	}
+}
+
+// Test that a lease which was cut short is renewed for the lease that was asked for rather than for what was last granted.
+func TestRenewalAsksForRequestedLease(t *testing.T) {
+	client := &shrinking_client{Client: must_client(t, root_url())}
+	manager := NewLeaseRenewalManager(client, WithRenewFraction(0.2), WithJitter(0))
+	defer manager.Close()
+	if _, err := manager.Register(context.Background(), NewService(map[string]string{"application": "shrunk"}, 1000, "", "shrunk123")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(client.requests()) < 3; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the lease to be renewed but it was only renewed with %v", client.requests())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, requested := range client.requests() {
+		if requested != 1000 {
+			t.Fatalf("Expected every renewal to ask for the full lease but got %v", client.requests())
+		}
+	}
+}
+
+// Records the leases that renewals ask for and grants the first one a quarter of what was asked for, as a busy LUS might.
+type shrinking_client struct {
+	Client
+	mutex     sync.Mutex
+	requested []int64
+}
+
+func (c *shrinking_client) Renew(ctx context.Context, url string, lease int64) (Registration, error) {
+	c.mutex.Lock()
+	c.requested = append(c.requested, lease)
+	first := len(c.requested) == 1
+	c.mutex.Unlock()
+	r, err := c.Client.Renew(ctx, url, lease)
+	if first {
+		r.Lease = lease / 4
+	}
+	return r, err
+}
+
+func (c *shrinking_client) requests() []int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]int64(nil), c.requested...)
+}
+
+// Test that a lease that is granted for 0 is given up on rather than renewed over and over.
+func TestZeroLease(t *testing.T) {
+	client := &zero_client{Client: must_client(t, root_url())}
+	manager := NewLeaseRenewalManager(client, WithRenewFraction(0.1), WithBackoff(time.Millisecond, 10*time.Millisecond))
+	defer manager.Close()
+	keys := map[string]string{"application": "zeroed"}
+
+	r, err := manager.Register(context.Background(), NewService(keys, 1000, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := next_lease_event(t, manager)
+	if lost.Type != LeaseLost || lost.Url != r.Url || !errors.Is(lost.Err, ErrNoLease) {
+		t.Fatalf("Expected the lease to be given up on but got %v", lost)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if manager.managing(r) || atomic.LoadInt32(&client.renewals) != 1 {
+		t.Fatalf("Expected the manager to have stopped renewing after %v renewals", client.renewals)
+	}
+
+	zero := Registration{Url: root_url() + "entry/zero", Lease: 0}
+	manager.ManageLease(zero)
+	if lost := next_lease_event(t, manager); lost.Type != LeaseLost || !errors.Is(lost.Err, ErrNoLease) || manager.managing(zero) {
+		t.Fatalf("Expected a lease of 0 not to be managed but got %v", lost)
+	}
+}
+
+// Grants every renewal a lease of 0, as a LUS whose policy has no default would for a renewal that asked for 0.
+type zero_client struct {
+	Client
+	renewals int32
+}
+
+func (c *zero_client) Renew(ctx context.Context, url string, lease int64) (Registration, error) {
+	atomic.AddInt32(&c.renewals, 1)
+	r, err := c.Client.Renew(ctx, url, lease)
+	r.Lease = 0
+	return r, err
+}
+
+func TestRenewalTiming(t *testing.T) {
+	manager := NewLeaseRenewalManager(nil, WithRenewFraction(0.5), WithJitter(0.1), WithBackoff(100*time.Millisecond, time.Second))
+	for i := 0; i < 100; i++ {
+		after := manager.renewAfter(10000)
+		if after < 4500*time.Millisecond || after > 5500*time.Millisecond {
+			t.Fatalf("Expected a renewal half way through the lease give or take 10%% but got %v", after)
+		}
+	}
+	if manager.renewAfter(0) != 100*time.Millisecond {
+		t.Fatal("Expected a short lease to be renewed no more often than the minimum backoff")
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	backoff := time.Duration(0)
+	for _, e := range expected {
+		backoff = manager.nextBackoff(backoff)
+		if backoff != e {
+			t.Fatalf("Expected a backoff of %v but got %v", e, backoff)
+		}
+	}
+}
+
+func next_lease_event(t *testing.T, manager *LeaseRenewalManager) Lease_event {
+	select {
+	case event := <-manager.Events():
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for a lease event")
+		return Lease_event{}
+	}
+}
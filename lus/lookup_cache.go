@@ -0,0 +1,223 @@
+package lus
+
+/**
+  A LookupCache is loosely based on the LookupCache from the Jini ServiceDiscoveryManager
+  (https://river.apache.org/doc/api/net/jini/lookup/LookupCache.html). It keeps a local copy of every Service that matches a
+  template by watching one or more LUS instances, so that lookups never need a network round trip. Services are de-duplicated
+  by their ID, so a provider that registers with several LUS instances only shows up once, and only goes away once every LUS
+  has forgotten about it. If a LUS can't be reached then what it told us is kept and the watch carries on from where it got to
+  once it is back. Only if it has been out of reach for longer than cache_forget_after are its Services forgotten.
+**/
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long to wait before watching a LUS again after it has failed.
+const cache_retry_wait = 1 * time.Second
+
+// How long a LUS can be out of reach before we forget the Services that it told us about.
+const cache_forget_after = 30 * time.Second
+
+// Callbacks that a LookupCache makes as its view of the matching Services changes. Any of them can be nil.
+type Cache_listener struct {
+	ServiceAdded   func(s Service)
+	ServiceRemoved func(s Service)
+	ServiceChanged func(s Service)
+}
+
+// Keeps an in-memory copy of the Services that match a template.
+type LookupCache struct {
+	keys         map[string]string
+	listener     Cache_listener
+	ctx          context.Context
+	cancel       context.CancelFunc // Stops any watches that are in progress
+	forget_after time.Duration
+
+	mutex    sync.RWMutex
+	sources  []map[string]Service // What each LUS currently knows about, by cache key
+	services map[string]Service   // The de-duplicated view across every LUS
+	closed   bool
+
+	update_mutex sync.Mutex // Makes sure that the callbacks are made in the order the changes are applied
+}
+
+// Creates a LookupCache for the Services matching the keys on the supplied LUS clients and starts keeping it up to date.
+func NewLookupCache(keys map[string]string, listener Cache_listener, clients ...Client) *LookupCache {
+	return newLookupCache(keys, listener, cache_forget_after, clients...)
+}
+
+func newLookupCache(keys map[string]string, listener Cache_listener, forget_after time.Duration, clients ...Client) *LookupCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := &LookupCache{
+		keys:         keys,
+		listener:     listener,
+		ctx:          ctx,
+		cancel:       cancel,
+		forget_after: forget_after,
+		sources:      make([]map[string]Service, len(clients)),
+		services:     make(map[string]Service),
+	}
+	for i, client := range clients {
+		cache.sources[i] = make(map[string]Service)
+		go cache.watch(i, client)
+	}
+	return cache
+}
+
+// Every Service in the cache.
+func (cache *LookupCache) Lookup() []Service {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	services := make([]Service, 0, len(cache.services))
+	for _, s := range cache.services {
+		services = append(services, s)
+	}
+	return services
+}
+
+// Any one of the Services in the cache. Returns false if the cache is empty.
+func (cache *LookupCache) LookupOne() (Service, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	for _, s := range cache.services {
+		return s, true
+	}
+	return Service{}, false
+}
+
+// Stop keeping the cache up to date. No more callbacks will be made.
+func (cache *LookupCache) Close() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.closed = true
+	cache.cancel()
+}
+
+func (cache *LookupCache) isClosed() bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.closed
+}
+
+// Keep watching a single LUS. If it fails then we carry on from the same index once it is back, so that nothing is lost or
+// repeated, unless it has been failing for so long that we have to forget what it told us. The LUS sends a reset itself if the
+// index is too old for it to know what has changed since.
+func (cache *LookupCache) watch(source int, client Client) {
+	var index int64 = 0
+	var failing_since time.Time
+	for !cache.isClosed() {
+		response, err := client.Watch(cache.ctx, cache.keys, index)
+		if cache.ctx.Err() != nil {
+			return // Closed
+		}
+		if err != nil {
+			log.Println("Unable to watch LUS:", client.Root_URL(), err)
+			if failing_since.IsZero() {
+				failing_since = time.Now()
+			}
+			if index != 0 && time.Since(failing_since) >= cache.forget_after {
+				cache.apply(source, Watch_response{Reset: true})
+				index = 0
+			}
+			select {
+			case <-cache.ctx.Done():
+				return
+			case <-time.After(cache_retry_wait):
+			}
+			continue
+		}
+		failing_since = time.Time{}
+		cache.apply(source, response)
+		index = response.Index
+	}
+}
+
+// Apply a watch response from a LUS and tell the listener about any changes to the de-duplicated view.
+func (cache *LookupCache) apply(source int, response Watch_response) {
+	cache.update_mutex.Lock()
+	defer cache.update_mutex.Unlock()
+
+	cache.mutex.Lock()
+	if cache.closed {
+		cache.mutex.Unlock()
+		return
+	}
+	touched := make(map[string]bool)
+	if response.Reset {
+		for key := range cache.sources[source] {
+			touched[key] = true
+		}
+		cache.sources[source] = make(map[string]Service)
+	}
+	for _, d := range response.Deltas {
+		key := cacheKey(d.Service)
+		touched[key] = true
+		if d.Type == DeltaRemoved {
+			delete(cache.sources[source], key)
+		} else {
+			cache.sources[source][key] = d.Service
+		}
+	}
+
+	var added, removed, changed []Service
+	for key := range touched {
+		before, was_cached := cache.services[key]
+		after, is_cached := cache.lookupSources(source, key)
+		switch {
+		case was_cached && !is_cached:
+			delete(cache.services, key)
+			removed = append(removed, before)
+		case !was_cached && is_cached:
+			cache.services[key] = after
+			added = append(added, after)
+		case was_cached && is_cached:
+			cache.services[key] = after
+			if attributesChanged(before, after) {
+				changed = append(changed, after)
+			}
+		}
+	}
+	cache.mutex.Unlock()
+
+	fire(cache.listener.ServiceRemoved, removed)
+	fire(cache.listener.ServiceAdded, added)
+	fire(cache.listener.ServiceChanged, changed)
+}
+
+// Find the Service in the sources, preferring the one that has just been updated.
+func (cache *LookupCache) lookupSources(preferred int, key string) (Service, bool) {
+	s, ok := cache.sources[preferred][key]
+	if ok {
+		return s, true
+	}
+	for _, source := range cache.sources {
+		s, ok = source[key]
+		if ok {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+// Services are de-duplicated by their ID. A Service without an ID falls back to its Keys.
+func cacheKey(s Service) string {
+	if s.ID != "" {
+		return s.ID
+	}
+	b, _ := json.Marshal(s.Keys) // Map keys are marshalled in sorted order so this is stable
+	return string(b)
+}
+
+func fire(callback func(s Service), services []Service) {
+	if callback == nil {
+		return
+	}
+	for _, s := range services {
+		callback(s)
+	}
+}
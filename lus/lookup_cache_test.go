@@ -0,0 +1,147 @@
+package lus
+
+/**
+  Test that a LookupCache mirrors and de-duplicates the Services registered with several LUS instances.
+**/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLookupCache(t *testing.T) {
+	a := must_client(t, start_test_lus(t, Options{MaxLease: 60000}))
+	b := must_client(t, start_test_lus(t, Options{MaxLease: 60000}))
+	keys := map[string]string{"application": "cached"}
+
+	events := make(chan string, 10)
+	cache := NewLookupCache(keys, Cache_listener{
+		ServiceAdded:   func(s Service) { events <- "added " + s.ID },
+		ServiceRemoved: func(s Service) { events <- "removed " + s.ID },
+		ServiceChanged: func(s Service) { events <- "changed " + s.ID + " " + s.Data },
+	}, a, b)
+	defer cache.Close()
+
+	on_a := must_register(t, a, NewService(keys, 10000, "1", "c123"))
+	assert_cache_event(t, events, "added c123")
+	on_b := must_register(t, b, NewService(keys, 10000, "2", "c123"))
+	assert_cache_event(t, events, "changed c123 2")
+
+	if len(cache.Lookup()) != 1 {
+		t.Fatalf("Expected one de-duplicated Service but got %v", cache.Lookup())
+	}
+	s, ok := cache.LookupOne()
+	if !ok || s.ID != "c123" {
+		t.Fatalf("LookupOne returned %v %v", s, ok)
+	}
+
+	// Only goes away once both LUS instances have forgotten about it.
+	b.Renew(context.Background(), on_b.Url, 0)
+	assert_cache_event(t, events, "changed c123 1")
+	a.Renew(context.Background(), on_a.Url, 0)
+	assert_cache_event(t, events, "removed c123")
+	if _, ok := cache.LookupOne(); ok {
+		t.Fatal("Expected the cache to be empty")
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	cache.Close()
+	time.Sleep(50 * time.Millisecond)
+	if logged.Len() > 0 {
+		t.Fatalf("Expected closing the cache not to be logged as a failure but got %v", logged.String())
+	}
+}
+
+// Test that a LUS going out of reach for a while doesn't empty the cache, unless it is out of reach for too long.
+func TestLookupCacheUnreachable(t *testing.T) {
+	transport := &flaky_transport{}
+	root := start_test_lus(t, Options{MaxLease: 60000})
+	client := must_client(t, root, WithHTTPClient(&http.Client{Transport: transport}))
+	keys := map[string]string{"application": "unreachable"}
+
+	kept, forgot := make(chan string, 10), make(chan string, 10)
+	listener := func(events chan string) Cache_listener {
+		return Cache_listener{
+			ServiceAdded:   func(s Service) { events <- "added " + s.ID },
+			ServiceRemoved: func(s Service) { events <- "removed " + s.ID },
+		}
+	}
+	keeping := newLookupCache(keys, listener(kept), time.Hour, client)
+	defer keeping.Close()
+	forgetting := newLookupCache(keys, listener(forgot), 0, client)
+	defer forgetting.Close()
+
+	must_register(t, must_client(t, root), NewService(keys, 60000, "", "u1"))
+	assert_cache_event(t, kept, "added u1")
+	assert_cache_event(t, forgot, "added u1")
+
+	transport.setDown(true)
+	assert_cache_event(t, forgot, "removed u1")
+	transport.setDown(false)
+	must_register(t, must_client(t, root), NewService(keys, 60000, "", "u2"))
+	assert_cache_event(t, kept, "added u2") // Carries on from its index without ever having dropped u1
+	if len(keeping.Lookup()) != 2 {
+		t.Fatalf("Expected the cache to have kept u1 but got %v", keeping.Lookup())
+	}
+	readded := map[string]bool{} // Starts again with a reset, which comes in any order
+	for len(readded) < 2 {
+		select {
+		case e := <-forgot:
+			readded[e] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the forgotten Services to be added again, got %v", readded)
+		}
+	}
+	if !readded["added u1"] || !readded["added u2"] {
+		t.Fatalf("Expected the forgotten Services to be added again but got %v", readded)
+	}
+}
+
+// Fails every request while it is down, including any that were in progress when it went down.
+type flaky_transport struct {
+	mutex   sync.Mutex
+	down    bool
+	cancels []context.CancelFunc
+}
+
+func (f *flaky_transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mutex.Lock()
+	if f.down {
+		f.mutex.Unlock()
+		return nil, errors.New("unreachable")
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	f.cancels = append(f.cancels, cancel)
+	f.mutex.Unlock()
+	return http.DefaultTransport.RoundTrip(r.WithContext(ctx))
+}
+
+func (f *flaky_transport) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+	for _, cancel := range f.cancels {
+		cancel()
+	}
+	f.cancels = nil
+}
+
+func assert_cache_event(t *testing.T, events chan string, expected string) {
+	select {
+	case e := <-events:
+		if e != expected {
+			t.Fatalf("Cache event %v is different to assertion %v", e, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for cache event %v", expected)
+	}
+}
@@ -11,6 +11,9 @@ To use: make sure the lus_server is running on the localmachine and then type: g
 
 import (
 	"log"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -53,3 +56,30 @@ func assert_num_entries(test string, entries []Service, num int) bool {
 	}
 	return ok
 }
+
+// Starts an in-process LUS with the supplied options on a free port and returns its root url.
+func start_test_lus(t *testing.T, options Options) string {
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	return serve_test_lus(t, options, urls, "")
+}
+
+// Starts an in-process LUS that hands out the urls and is mounted at the path prefix.
+func serve_test_lus(t *testing.T, options Options, urls *Advertised_urls, prefix string) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.StripPrefix(prefix, test_lus_handler(t, options, urls))}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "http://localhost:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port) + prefix + "/"
+}
+
+// Starts a LUS with the supplied options and returns the handlers for it.
+func test_lus_handler(t *testing.T, options Options, urls *Advertised_urls) http.Handler {
+	request_chan, err := StartWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Routes(request_chan, urls, options.Groups)
+}
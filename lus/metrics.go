@@ -0,0 +1,211 @@
+package lus
+
+/**
+  Metrics about the LUS in the Prometheus text exposition format (see https://prometheus.io/docs/instrumenting/exposition_formats/)
+  so that it can be scraped from /metrics. They are written out by hand rather than with the Prometheus client library to keep
+  the dependencies down. Every metric is labelled with the namespace it is for, which is empty for the default namespace:
+
+      lus_entries                  The live entries
+      lus_entries_by_key           The live entries broken down by the value of the configured key e.g. application
+      lus_registrations_total      Registrations made
+      lus_renewals_total           Leases renewed, by clients or renewal sets
+      lus_expirations_total        Entries dropped because their lease ran out
+      lus_cancellations_total      Entries cancelled before their lease ran out
+      lus_leases_capped_total      Leases that were granted for less than was asked for
+      lus_lease_granted_seconds    Histogram of the leases granted to registrations and renewals
+      lus_find_duration_seconds    Histogram of how long finds take, including the time spent queueing for the lus goroutine
+      lus_request_queue_depth      Requests waiting for the lus goroutine
+
+  The counters only ever go up, so the rate per second is worked out by Prometheus e.g. rate(lus_registrations_total[1m]). The
+  metrics for a namespace are only reported to a Principal that has a Metrics rule in it (see auth.go), as the entries by key
+  give away what is registered there.
+  Everything but the queue depth is kept by the lus goroutine that it is about and is fetched with a "metrics" request.
+**/
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The upper bounds of the histogram buckets in seconds.
+var (
+	Find_duration_buckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	Lease_granted_buckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// Internal struct for the metrics that are kept by the lus goroutine. Only the goroutine touches it so nothing needs locking.
+type lus_metrics struct {
+	registrations int64
+	renewals      int64
+	expirations   int64
+	cancellations int64
+	capped        int64
+	find_duration histogram
+	lease_granted histogram
+}
+
+func newLusMetrics() lus_metrics {
+	return lus_metrics{find_duration: newHistogram(Find_duration_buckets), lease_granted: newHistogram(Lease_granted_buckets)}
+}
+
+// Records the lease that was granted for a requested one.
+func (m *lus_metrics) granted(requested int64, lease int64) {
+	m.lease_granted.observe(float64(lease) / 1000)
+	if lease < requested {
+		m.capped++
+	}
+}
+
+// A copy that can be handed to another goroutine.
+func (m lus_metrics) snapshot() lus_metrics {
+	m.find_duration = m.find_duration.snapshot()
+	m.lease_granted = m.lease_granted.snapshot()
+	return m
+}
+
+// Counts of observations in buckets.
+type histogram struct {
+	bounds []float64
+	counts []int64 // How many observations fell into each bucket (not cumulative), with the last one for anything bigger
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h histogram) snapshot() histogram {
+	h.counts = append([]int64(nil), h.counts...)
+	return h
+}
+
+// What the lus goroutine sends back for a "metrics" request.
+type metrics_snapshot struct {
+	metrics lus_metrics
+	entries int
+	by_key  map[string]int // The number of entries with each value of the key. Entries without the key are counted under ""
+}
+
+// Counts the entries by the value they have for the key.
+func countByKey(entries map[string]entry_state, key string) map[string]int {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.service.Keys[key]]++
+	}
+	return counts
+}
+
+// Serves the metrics for the LUSes using the request channels, which are keyed by the name of their namespace ("" for the default
+// one). If the key isn't empty then the live entries are also broken down by their value for that key. Only the namespaces that
+// may_scrape allows for the request are reported (see Namespaces.MayScrape), or every one if it is nil.
+func Metrics(request_channels map[string]chan Request, key string, may_scrape func(r *http.Request, namespace string) bool, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	names := make([]string, 0, len(request_channels))
+	for name := range request_channels {
+		if may_scrape == nil || may_scrape(r, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		writeError(w, notAllowed(accessFor(r).who(), "Not allowed to scrape the metrics"))
+		return
+	}
+	sort.Strings(names)
+	depths := make([]int, len(names)) // Before our own requests join the queue
+	for i, name := range names {
+		depths[i] = len(request_channels[name])
+	}
+	snapshots := make([]metrics_snapshot, len(names))
+	for i, name := range names {
+		response_chan := make(chan response)
+		request_channels[name] <- Request{q: "metrics", response_channel: response_chan, key: key}
+		snapshots[i] = *(<-response_chan).metrics
+	}
+
+	var b bytes.Buffer
+	family := func(metric string, kind string, help string) {
+		b.WriteString("# HELP " + metric + " " + help + "\n# TYPE " + metric + " " + kind + "\n")
+	}
+	sample := func(metric string, labels string, value string) {
+		b.WriteString(metric + "{" + labels + "} " + value + "\n")
+	}
+	each := func(metric string, kind string, help string, value func(s metrics_snapshot) int64) {
+		family(metric, kind, help)
+		for i, name := range names {
+			sample(metric, label("namespace", name), strconv.FormatInt(value(snapshots[i]), 10))
+		}
+	}
+	each("lus_entries", "gauge", "The live entries.", func(s metrics_snapshot) int64 { return int64(s.entries) })
+	if key != "" {
+		family("lus_entries_by_key", "gauge", "The live entries by their value for the key.")
+		for i, name := range names {
+			values := make([]string, 0, len(snapshots[i].by_key))
+			for value := range snapshots[i].by_key {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			for _, value := range values {
+				sample("lus_entries_by_key", label("namespace", name)+","+label("key", key)+","+label("value", value), strconv.Itoa(snapshots[i].by_key[value]))
+			}
+		}
+	}
+	each("lus_registrations_total", "counter", "Registrations made.", func(s metrics_snapshot) int64 { return s.metrics.registrations })
+	each("lus_renewals_total", "counter", "Leases renewed, by clients or renewal sets.", func(s metrics_snapshot) int64 { return s.metrics.renewals })
+	each("lus_expirations_total", "counter", "Entries dropped because their lease ran out.", func(s metrics_snapshot) int64 { return s.metrics.expirations })
+	each("lus_cancellations_total", "counter", "Entries cancelled before their lease ran out.", func(s metrics_snapshot) int64 { return s.metrics.cancellations })
+	each("lus_leases_capped_total", "counter", "Leases that were granted for less than was asked for.", func(s metrics_snapshot) int64 { return s.metrics.capped })
+	histograms := func(metric string, help string, h func(s metrics_snapshot) histogram) {
+		family(metric, "histogram", help)
+		for i, name := range names {
+			writeHistogram(&b, metric, label("namespace", name), h(snapshots[i]))
+		}
+	}
+	histograms("lus_lease_granted_seconds", "The leases granted to registrations and renewals.", func(s metrics_snapshot) histogram { return s.metrics.lease_granted })
+	histograms("lus_find_duration_seconds", "How long finds take, including queueing for the lus goroutine.", func(s metrics_snapshot) histogram { return s.metrics.find_duration })
+	family("lus_request_queue_depth", "gauge", "Requests waiting for the lus goroutine.")
+	for i, name := range names {
+		sample("lus_request_queue_depth", label("namespace", name), strconv.Itoa(depths[i]))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// Writes the cumulative buckets, sum and count of a histogram.
+func writeHistogram(b *bytes.Buffer, metric string, labels string, h histogram) {
+	var cumulative int64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		b.WriteString(metric + "_bucket{" + labels + "," + label("le", le) + "} " + strconv.FormatInt(cumulative, 10) + "\n")
+	}
+	b.WriteString(metric + "_sum{" + labels + "} " + formatFloat(h.sum) + "\n")
+	b.WriteString(metric + "_count{" + labels + "} " + strconv.FormatInt(h.count, 10) + "\n")
+}
+
+// A label with its value escaped.
+func label(name string, value string) string {
+	return name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
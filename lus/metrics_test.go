@@ -0,0 +1,161 @@
+package lus
+
+/**
+  Test that /metrics counts what the LUS does, is written in the Prometheus text format and only reports what the caller may see.
+**/
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Scrapes the metrics.
+func scrape(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if content_type := resp.Header.Get("Content-Type"); !strings.HasPrefix(content_type, "text/plain; version=0.0.4") {
+		t.Fatalf("Expected the Prometheus text format but got %v", content_type)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestMetrics(t *testing.T) {
+	request_chan, err := StartWithOptions(Options{MaxLease: 30000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	mux := http.NewServeMux()
+	mux.Handle("/", Routes(request_chan, urls, nil))
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		Metrics(map[string]chan Request{"": request_chan}, "application", nil, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := must_client(t, server.URL+"/")
+	ctx := context.Background()
+
+	api := must_register(t, client, NewService(map[string]string{"application": "api"}, 60000, "", "m1")) // Capped at 30s
+	worker := must_register(t, client, NewService(map[string]string{"application": "worker"}, 10000, "", "m2"))
+	must_register(t, client, NewService(map[string]string{"application": `say "hi"`}, 1, "", "m3")) // Expires straight away
+	if _, err := client.Renew(ctx, api.Url, 10000); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Cancel(ctx, worker); err != nil {
+		t.Fatal(err)
+	}
+	must_find(t, client, map[string]string{"application": "api"})
+
+	var metrics string
+	for i := 0; !strings.Contains(metrics, `lus_expirations_total{namespace=""} 1`); i++ {
+		if i == 100 {
+			t.Fatalf("Expected the short lease to expire but got\n%v", metrics)
+		}
+		time.Sleep(20 * time.Millisecond)
+		metrics = scrape(t, server.URL+"/metrics")
+	}
+	for _, line := range []string{
+		"# TYPE lus_entries gauge",
+		`lus_entries{namespace=""} 1`,
+		`lus_entries_by_key{namespace="",key="application",value="api"} 1`,
+		`lus_registrations_total{namespace=""} 3`,
+		`lus_renewals_total{namespace=""} 1`,
+		`lus_cancellations_total{namespace=""} 1`,
+		`lus_leases_capped_total{namespace=""} 1`,
+		"# TYPE lus_lease_granted_seconds histogram",
+		`lus_lease_granted_seconds_bucket{namespace="",le="10"} 3`,
+		`lus_lease_granted_seconds_bucket{namespace="",le="30"} 4`,
+		`lus_lease_granted_seconds_bucket{namespace="",le="+Inf"} 4`,
+		`lus_lease_granted_seconds_count{namespace=""} 4`,
+		`lus_find_duration_seconds_count{namespace=""} 1`,
+		`lus_request_queue_depth{namespace=""} 0`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("Expected %v in\n%v", line, metrics)
+		}
+	}
+	if l := label("value", "say \"hi\"\\\n"); l != `value="say \"hi\"\\\n"` {
+		t.Fatalf("Expected the label value to be escaped but got %v", l)
+	}
+}
+
+// Scrapes the metrics with the bearer token, if any, returning the status and the body.
+func scrape_as(t *testing.T, url string, token string) (int, string) {
+	r, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestMetricsAccess(t *testing.T) {
+	auth := Auth_config{
+		Tokens: []Auth_token{
+			{Token: "billing-token", Principal: Principal{Name: "billing-svc", Teams: []string{"billing"}}},
+			{Token: "ops-token", Principal: Principal{Name: "dashboard", Teams: []string{"ops"}}},
+			{Token: "monitor-token", Principal: Principal{Name: "prometheus"}},
+		},
+		Anonymous: true,
+		Rules: []Access_rule{
+			{Name: "billing", Teams: []string{"billing"}, Register: map[string]string{}, Lookup: map[string]string{}},
+			{Name: "monitoring", Principals: []string{"prometheus"}, Metrics: true},
+		},
+	}
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	request_chan, err := StartWithOptions(Options{MaxLease: 60000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_chans := map[string]chan Request{"": request_chan}
+	n := NewNamespaces(Routes(request_chan, urls, nil), urls, nil)
+	for name, rules := range map[string][]Access_rule{
+		"billing": nil,
+		"ops":     {{Name: "ops", Teams: []string{"ops"}, Register: map[string]string{}, Lookup: map[string]string{}, Metrics: true}},
+		"sealed":  {},
+	} {
+		if request_chans[name], err = StartWithOptions(Options{MaxLease: 60000}); err != nil {
+			t.Fatal(err)
+		}
+		n.Add(name, request_chans[name], rules)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", n)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		Metrics(request_chans, "application", n.MayScrape, w, r)
+	})
+	server := httptest.NewServer(NewAuthHandler(mux, auth))
+	defer server.Close()
+	ops := must_client(t, server.URL+"/", WithBearerToken("ops-token"), WithNamespace("ops"))
+	must_register(t, ops, NewService(map[string]string{"application": "dashboard"}, 10000, "", "o1"))
+
+	for _, token := range []string{"", "billing-token"} {
+		if status, metrics := scrape_as(t, server.URL+"/metrics", token); status != http.StatusForbidden || strings.Contains(metrics, "dashboard") {
+			t.Fatalf("Expected %q not to be let scrape the metrics but got %v\n%v", token, status, metrics)
+		}
+	}
+	_, metrics := scrape_as(t, server.URL+"/metrics", "monitor-token")
+	if !strings.Contains(metrics, `lus_entries{namespace=""} 0`) || !strings.Contains(metrics, `lus_entries{namespace="billing"} 0`) ||
+		strings.Contains(metrics, `namespace="ops"`) || strings.Contains(metrics, `namespace="sealed"`) {
+		t.Fatalf("Expected the monitor to only see the namespaces under the Auth rules but got\n%v", metrics)
+	}
+	_, metrics = scrape_as(t, server.URL+"/metrics", "ops-token")
+	if !strings.Contains(metrics, `lus_entries_by_key{namespace="ops",key="application",value="dashboard"} 1`) ||
+		strings.Contains(metrics, `namespace=""`) || strings.Contains(metrics, `namespace="billing"`) {
+		t.Fatalf("Expected ops to only see its own namespace but got\n%v", metrics)
+	}
+}
@@ -0,0 +1,126 @@
+package lus
+
+/**
+  Changing the attributes of a registered Service in place, loosely based on Jini's ServiceRegistration.modifyAttributes
+  (https://river.apache.org/doc/api/net/jini/core/lookup/ServiceRegistration.html). A provider PATCHes its entry url with a list
+  of changes to its keys (and optionally a replacement for its Data). The changes are applied all together or not at all, the
+  entry keeps its url and lease, and its version is bumped so that listeners, watches and peers all see the change.
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// The operations that can be used in an Attribute_change.
+const (
+	Op_add     = "add"     // Adds a key that the Service doesn't already have
+	Op_replace = "replace" // Changes the value of a key that the Service already has, or the Data if no Key is given
+	Op_remove  = "remove"  // Removes a key that the Service has
+)
+
+// Represents the JSON data struct for a single change to the attributes of a Service. A PATCH takes a list of them.
+type Attribute_change struct {
+	Op    string
+	Key   string `json:",omitempty"` // Leave out to replace the Data
+	Value string `json:",omitempty"`
+}
+
+// Add a key to a Service.
+func AddKey(key string, value string) Attribute_change {
+	return Attribute_change{Op: Op_add, Key: key, Value: value}
+}
+
+// Change the value of one of the keys of a Service.
+func ReplaceKey(key string, value string) Attribute_change {
+	return Attribute_change{Op: Op_replace, Key: key, Value: value}
+}
+
+// Remove a key from a Service.
+func RemoveKey(key string) Attribute_change {
+	return Attribute_change{Op: Op_remove, Key: key}
+}
+
+// Replace the Data of a Service.
+func ReplaceData(data string) Attribute_change {
+	return Attribute_change{Op: Op_replace, Value: data}
+}
+
+// Check that the changes make sense on their own, before we know anything about the Service they will be applied to.
+func validateChanges(changes []Attribute_change) *Error {
+	if len(changes) == 0 {
+		return badRequest("No changes were supplied")
+	}
+	for _, c := range changes {
+		switch {
+		case c.Op != Op_add && c.Op != Op_replace && c.Op != Op_remove:
+			return badRequest("Unknown operation").with("Op", c.Op)
+		case c.Key == "" && c.Op != Op_replace:
+			return badRequest("The operation needs a Key").with("Op", c.Op)
+		case c.Key != "":
+			err := validateKey(c.Key, c.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply the changes to a copy of the Service. Returns an error, and leaves the Service alone, if any of them can't be applied.
+func applyChanges(s Service, changes []Attribute_change) (Service, error) {
+	keys := make(map[string]string, len(s.Keys))
+	for k, v := range s.Keys {
+		keys[k] = v
+	}
+	for _, c := range changes {
+		_, exists := keys[c.Key]
+		switch {
+		case c.Key == "":
+			s.Data = c.Value
+		case c.Op == Op_add && exists:
+			return s, errors.New("modify: the Service already has the key " + c.Key)
+		case c.Op != Op_add && !exists:
+			return s, errors.New("modify: the Service doesn't have the key " + c.Key)
+		case c.Op == Op_remove:
+			delete(keys, c.Key)
+		default:
+			keys[c.Key] = c.Value
+		}
+	}
+	s.Keys = keys
+	return s, nil
+}
+
+// Wrapper func that is called when a client PATCHes an entry url.
+func modifyEntry(request_channel chan Request, id string, w http.ResponseWriter, r *http.Request) {
+	var changes []Attribute_change
+	err := readJSON(w, r, &changes)
+	if err == nil {
+		err = validateChanges(changes)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response_chan := make(chan response)
+	request_channel <- Request{q: "modify", response_channel: response_chan, id: id, changes: changes, version: expectedVersion(r), token: r.Header.Get(Lease_token_header), may_register: accessFor(r).mayRegister}
+	response := <-response_chan
+	conflict, is_conflict := response.err.(*Version_conflict)
+	e, is_error := response.err.(*Error)
+	switch {
+	case response.id == "":
+		writeError(w, notFound(id))
+	case is_error:
+		writeError(w, e)
+	case is_conflict:
+		preconditionFailed(w, conflict.Version)
+	case response.err != nil:
+		writeError(w, newError(http.StatusConflict, Code_conflict, response.err.Error()))
+	default:
+		w.Header().Set("ETag", etagFor(response.version))
+		b, _ := json.Marshal(response.matches[0])
+		w.Write(b)
+	}
+}
@@ -0,0 +1,35 @@
+package lus
+
+/**
+  Test that attribute changes are validated and applied all together or not at all.
+**/
+
+import (
+	"testing"
+)
+
+func TestApplyChanges(t *testing.T) {
+	s := NewService(map[string]string{"status": "up", "weight": "10"}, 1000, "v1", "a")
+
+	if validateChanges(nil) == nil || validateChanges([]Attribute_change{{Op: "move", Key: "status"}}) == nil || validateChanges([]Attribute_change{{Op: Op_remove}}) == nil {
+		t.Fatal("Expected invalid changes to be rejected")
+	}
+
+	modified, err := applyChanges(s, []Attribute_change{ReplaceKey("status", "draining"), RemoveKey("weight"), AddKey("zone", "a"), ReplaceData("v2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modified.Keys) != 2 || modified.Keys["status"] != "draining" || modified.Keys["zone"] != "a" || modified.Data != "v2" {
+		t.Fatalf("Changes were not applied: %v", modified)
+	}
+	if s.Keys["status"] != "up" || len(s.Keys) != 2 {
+		t.Fatalf("The original Service was changed: %v", s)
+	}
+
+	for _, c := range []Attribute_change{AddKey("status", "down"), ReplaceKey("zone", "b"), RemoveKey("zone")} {
+		_, err = applyChanges(s, []Attribute_change{ReplaceKey("weight", "5"), c})
+		if err == nil {
+			t.Fatalf("Expected %v to fail", c)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package lus
+
+/**
+  Namespaces let teams share a LUS without sharing their registrations. Each namespace is a registry of its own, run by its own
+  lus goroutine, with its own lease policy, quotas on how many entries it holds and how big their Data can be, and optionally
+  its own access rules. A namespace is used either through its urls e.g. /ns/billing/register and /ns/billing/find or by sending
+  the Lus-Namespace header with the usual urls. Either way the urls that it hands out are under /ns/billing/ so that they work
+  without the header. Requests that don't name a namespace go to the default one, which is the LUS as it always was.
+
+  Lookups never cross from one namespace into another. The only way for registrations to get between them is to federate a
+  namespace explicitly by giving it Peers, which it gossips with just as the LUS does (see gossip.go). The peers are usually the
+  same namespace on other LUS instances e.g. http://lus2.example.com/ns/billing/.
+
+  The webroot lists the namespaces that the caller can see as link relations. A namespace with its own rules can only be seen
+  (or used) by the principals that one of its rules applies to; to anyone else it doesn't exist.
+**/
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The header that picks the namespace for a request that is sent to the usual urls.
+const Namespace_header = "Lus-Namespace"
+
+// The path that the namespaces are mounted under.
+const Namespace_path = "/ns/"
+
+// The most characters a namespace name can have.
+const Max_namespace_size = 64
+
+// The settings for a namespace.
+type Namespace_config struct {
+	Name        string        // Lower case letters, digits, - and _
+	MaxLease    int64         // Maximum lease time that will be handed out in ms. 0 uses the LUS's MaxLease
+	Policy      *Lease_policy `json:",omitempty"` // If nil every lease is just capped at the MaxLease
+	MaxEntries  int           // The most entries, counting any gossiped from the Peers, before registrations are turned away. 0 means no limit
+	MaxDataSize int           // The biggest Data a Service can have in bytes. 0 means no limit
+	Rules       []Access_rule // Replace the Auth Rules inside the namespace. If nil the Auth Rules apply, if empty nobody can use it
+	Peers       []string      // Root urls to federate the namespace with
+}
+
+// Can the name be used for a namespace? It ends up in urls and directory names so only a few characters are allowed.
+func validNamespace(name string) bool {
+	if name == "" || len(name) > Max_namespace_size {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// The lease settings to start, or Reconfigure, the namespace with given the MaxLease of the LUS.
+func (ns Namespace_config) LeaseOptions(max_lease int64) Options {
+	if ns.MaxLease > 0 {
+		max_lease = ns.MaxLease
+	}
+	return Options{MaxLease: float64(max_lease), Policy: ns.Policy}
+}
+
+// Turns away a Service that would take the registry over its quotas, given how many entries there would be.
+func (options Options) checkQuota(s Service, entries int) error {
+	if options.MaxDataSize > 0 && len(s.Data) > options.MaxDataSize {
+		return newError(http.StatusRequestEntityTooLarge, Code_too_large, "The Data is too large").with("Limit", strconv.Itoa(options.MaxDataSize))
+	}
+	if options.MaxEntries > 0 && entries > options.MaxEntries {
+		return newError(http.StatusForbidden, Code_quota_exceeded, "There is no room for any more entries").with("Limit", strconv.Itoa(options.MaxEntries))
+	}
+	return nil
+}
+
+// Sends each request to the namespace it names, or to the default one.
+type Namespaces struct {
+	handler    http.Handler // The default namespace
+	urls       *Advertised_urls
+	groups     []string
+	namespaces map[string]*namespace
+}
+
+type namespace struct {
+	handler http.Handler
+	rules   atomic.Pointer[[]Access_rule] // Can be swapped while requests are being served
+}
+
+// Creates the Namespaces with just the default namespace, which is served by the handler (usually from Routes).
+func NewNamespaces(handler http.Handler, urls *Advertised_urls, groups []string) *Namespaces {
+	return &Namespaces{handler: handler, urls: urls, groups: groups, namespaces: make(map[string]*namespace)}
+}
+
+// Adds a namespace that is served by the LUS using the request channel. If rules is nil the Auth Rules apply, whereas an empty
+// list of rules lets nobody in. All of the namespaces must be added before the first request is served.
+func (n *Namespaces) Add(name string, request_channel chan Request, rules []Access_rule) {
+	ns := &namespace{handler: Routes(request_channel, n.urls.Under(Namespace_path+name), n.groups)}
+	ns.rules.Store(&rules)
+	n.namespaces[name] = ns
+}
+
+// Swap in new rules for a namespace, which are used from the next request on. Returns false if there is no such namespace.
+func (n *Namespaces) SetRules(name string, rules []Access_rule) bool {
+	ns, ok := n.namespaces[name]
+	if ok {
+		ns.rules.Store(&rules)
+	}
+	return ok
+}
+
+func (n *Namespaces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	path := r.URL.Path
+	var name string
+	if strings.HasPrefix(path, Namespace_path) {
+		name, path, _ = strings.Cut(strings.TrimPrefix(path, Namespace_path), "/")
+		path = "/" + path
+	} else if name = r.Header.Get(Namespace_header); name == "" {
+		if path == "/" {
+			n.root(w, r)
+		} else {
+			n.handler.ServeHTTP(w, r)
+		}
+		return
+	}
+	ns, ok := n.namespaces[name]
+	if !ok || !ns.visible(r) {
+		writeError(w, newError(http.StatusNotFound, Code_not_found, "There is no such namespace").with("Namespace", name))
+		return
+	}
+	scoped := r.WithContext(context.WithValue(r.Context(), access_key{}, ns.access(r)))
+	scoped.URL = new(url.URL)
+	*scoped.URL = *r.URL
+	scoped.URL.Path, scoped.URL.RawPath = path, ""
+	ns.handler.ServeHTTP(w, scoped)
+}
+
+// The webroot of the default namespace, along with the namespaces the caller can see.
+func (n *Namespaces) root(w http.ResponseWriter, r *http.Request) {
+	rels := rootLinks(n.urls, n.groups, r)
+	names := make([]string, 0, len(n.namespaces))
+	for name, ns := range n.namespaces {
+		if ns.visible(r) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rels = append(rels, LinkRelation{Href: n.urls.For(r, Namespace_path+name+"/"), Rel: Rel_namespace})
+	}
+	b, _ := json.Marshal(rels)
+	w.Write(b)
+}
+
+// May the caller scrape the metrics of the namespace ("" for the default one)? Only if one of the rules that apply to them in
+// the namespace is a Metrics rule.
+func (n *Namespaces) MayScrape(r *http.Request, name string) bool {
+	if name == "" {
+		return accessFor(r).mayScrape()
+	}
+	ns, ok := n.namespaces[name]
+	return ok && ns.access(r).mayScrape()
+}
+
+// The access for a request within the namespace.
+func (ns *namespace) access(r *http.Request) *access {
+	a := accessFor(r)
+	rules := *ns.rules.Load()
+	if rules == nil {
+		return a
+	}
+	return &access{principal: a.who(), rules: rules}
+}
+
+// Can the caller see the namespace? Only if one of its rules applies to them.
+func (ns *namespace) visible(r *http.Request) bool {
+	return ns.access(r).allows(func(Access_rule) bool { return true })
+}
@@ -0,0 +1,126 @@
+package lus
+
+/**
+  Test that each namespace keeps its registrations to itself, enforces its own quotas and is only seen by the principals its
+  rules apply to.
+**/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves a LUS with the namespaces behind an Auth_handler and returns the Namespaces and its root url.
+func serve_namespaces(t *testing.T, auth Auth_config, namespaces map[string]Options, rules map[string][]Access_rule) (*Namespaces, string) {
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	n := NewNamespaces(test_lus_handler(t, Options{MaxLease: 60000}, urls), urls, nil)
+	for name, options := range namespaces {
+		request_chan, err := StartWithOptions(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Add(name, request_chan, rules[name])
+	}
+	server := httptest.NewServer(NewAuthHandler(n, auth))
+	t.Cleanup(server.Close)
+	return n, server.URL + "/"
+}
+
+// The namespaces listed in the webroot.
+func listed_namespaces(t *testing.T, root string, token string) []string {
+	r, _ := http.NewRequest("GET", root, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rels []LinkRelation
+	json.NewDecoder(resp.Body).Decode(&rels)
+	listed := []string{}
+	for _, rel := range rels {
+		if rel.Rel == Rel_namespace {
+			listed = append(listed, strings.TrimPrefix(rel.Href, root))
+		}
+	}
+	return listed
+}
+
+func TestNamespaces(t *testing.T) {
+	auth := Auth_config{Tokens: []Auth_token{
+		{Token: "billing-token", Principal: Principal{Name: "billing-svc", Teams: []string{"billing"}}},
+		{Token: "ops-token", Principal: Principal{Name: "dashboard", Teams: []string{"ops"}}},
+	}}
+	n, root := serve_namespaces(t, auth,
+		map[string]Options{"billing": {MaxLease: 60000, MaxEntries: 2, MaxDataSize: 16}, "ops": {MaxLease: 60000}, "sealed": {MaxLease: 60000}},
+		map[string][]Access_rule{"ops": {{Name: "ops", Teams: []string{"ops"}, Register: map[string]string{}, Lookup: map[string]string{}}}, "sealed": {}})
+	ctx := context.Background()
+	billing := must_client(t, root, WithBearerToken("billing-token"), WithNamespace("billing"))
+	everywhere := must_client(t, root, WithBearerToken("billing-token"))
+
+	r := must_register(t, billing, NewService(map[string]string{"application": "billing-api"}, 10000, "", "b1"))
+	if !strings.HasPrefix(r.Url, root+"ns/billing/entry/") {
+		t.Fatalf("Expected the entry to be under the namespace but got %v", r.Url)
+	}
+	if _, err := billing.Renew(ctx, r.Url, 10000); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("billing", must_find(t, billing, map[string]string{"application": "billing-api"}), 1)
+	assert_num_entries("default", must_find(t, everywhere, map[string]string{"application": "billing-api"}), 0)
+
+	find, _ := http.NewRequest("POST", root+"find", bytes.NewBufferString(`{"Keys": {"application": "billing-api"}}`))
+	find.Header.Set("Authorization", "Bearer billing-token")
+	find.Header.Set(Namespace_header, "billing")
+	resp, err := http.DefaultClient.Do(find)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []Service
+	json.NewDecoder(resp.Body).Decode(&found)
+	resp.Body.Close()
+	assert_num_entries("header", found, 1)
+
+	if _, err := billing.Register(ctx, NewService(map[string]string{"application": "billing-api"}, 10000, strings.Repeat("x", 17), "b2")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Expected Data over the limit to be turned down but got %v", err)
+	}
+	must_register(t, billing, NewService(map[string]string{"application": "billing-ui"}, 10000, "", "b3"))
+	_, err = billing.Register(ctx, NewService(map[string]string{"application": "billing-db"}, 10000, "", "b4"))
+	var full *Error
+	if !errors.Is(err, ErrQuotaExceeded) || !errors.As(err, &full) || full.Status != http.StatusForbidden {
+		t.Fatalf("Expected the namespace to be full but got %v", err)
+	}
+	must_register(t, everywhere, NewService(map[string]string{"application": "billing-db"}, 10000, "", "b4")) // The default namespace has no quota
+
+	if listed := listed_namespaces(t, root, "billing-token"); strings.Join(listed, ",") != "ns/billing/" {
+		t.Fatalf("Expected billing to only see its own namespace but got %v", listed)
+	}
+	if listed := listed_namespaces(t, root, "ops-token"); strings.Join(listed, ",") != "ns/billing/,ns/ops/" {
+		t.Fatalf("Expected ops to see both namespaces but got %v", listed)
+	}
+	if _, err := NewClient(ctx, root, WithBearerToken("billing-token"), WithNamespace("ops")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected billing not to be able to use the ops namespace but got %v", err)
+	}
+	if _, err := NewClient(ctx, root, WithBearerToken("billing-token"), WithNamespace("payroll")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a namespace that doesn't exist not to be found but got %v", err)
+	}
+	if _, err := NewClient(ctx, root, WithBearerToken("ops-token"), WithNamespace("sealed")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a namespace with an empty list of rules to let nobody in but got %v", err)
+	}
+	ops := must_client(t, root, WithBearerToken("ops-token"), WithNamespace("ops"))
+	must_register(t, ops, NewService(map[string]string{"application": "dashboard"}, 10000, "", "o1"))
+
+	if !n.SetRules("ops", []Access_rule{}) || n.SetRules("payroll", nil) {
+		t.Fatal("Expected only the namespaces that exist to have their rules set")
+	}
+	if _, err := ops.Find(ctx, map[string]string{"application": "dashboard"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the new rules to shut ops out but got %v", err)
+	}
+	n.SetRules("ops", nil) // The Auth Rules, of which there are none
+	assert_num_entries("reopened", must_find(t, must_client(t, root, WithBearerToken("billing-token"), WithNamespace("ops")), map[string]string{"application": "dashboard"}), 1)
+}
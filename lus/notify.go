@@ -0,0 +1,216 @@
+package lus
+
+/**
+  Remote event notifications, the equivalent of the Jini ServiceRegistrar.notify call. A client registers a template (with the
+  same matching rules as find) plus a callback URL and a lease. Whenever a registration moves into or out of the set that matches
+  the template, or a matching registration changes, the LUS POSTs an Event to the callback URL. Events carry a per listener
+  sequence number so that a receiver can spot that it has missed something (e.g. because it was too slow and we dropped events).
+**/
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// The transitions that an Event can describe.
+const (
+	TransitionMatchNoMatch = "MATCH_NOMATCH" // A registration that matched the template no longer does (or has gone away)
+	TransitionNoMatchMatch = "NOMATCH_MATCH" // A registration now matches the template (or has just been registered)
+	TransitionMatchMatch   = "MATCH_MATCH"   // A registration that matched the template has changed but still matches
+)
+
+// How many undelivered events we will queue for a listener before we start dropping them.
+const event_queue_size = 100
+
+// Represents the JSON data struct that is POSTed to the callback URL of a listener.
+type Event struct {
+	Listener   string // The ID of the notify registration that this event is for
+	Seq        int64  // Increases by one for every event generated for the listener
+	Transition string
+	Service    Service
+}
+
+// Represents the JSON data struct that lets clients ask to be notified about changes to matching registrations.
+type Notify_request struct {
+	Keys     map[string]string
+	Groups   []string
+	Query    string
+	Callback string
+	Lease    int64
+}
+
+// Internal struct to track a notify registration.
+type listener_state struct {
+	template template
+	callback string
+	expiry   time.Time
+	seq      int64
+	events   chan Event
+	token    string // Hash of the lease token that has to be sent to renew the listener
+}
+
+// Work out which transition (if any) a change to an entry represents for the template. A nil before means the entry has just been
+// registered and a nil after means that it has gone away. Returns an empty transition if the template does not care about the change.
+func transitionFor(t template, before *entry_state, after *entry_state) (string, Service) {
+	was_match := before != nil && matchesTemplate(t, *before)
+	is_match := after != nil && matchesTemplate(t, *after)
+
+	switch {
+	case was_match && !is_match:
+		return TransitionMatchNoMatch, versioned(before)
+	case !was_match && is_match:
+		return TransitionNoMatchMatch, versioned(after)
+	case was_match && is_match && attributesChanged(before.service, after.service):
+		return TransitionMatchMatch, versioned(after)
+	}
+	return "", Service{}
+}
+
+// The Service of an entry along with the version of the entry.
+func versioned(e *entry_state) Service {
+	s := e.service
+	s.Version = e.version
+	return s
+}
+
+// Queue up an Event for the listener if the change to the entry is one that it cares about.
+func notifyListener(id string, l *listener_state, before *entry_state, after *entry_state) {
+	transition, service := transitionFor(l.template, before, after)
+	if transition == "" {
+		return
+	}
+
+	l.seq++
+	select {
+	case l.events <- Event{Listener: id, Seq: l.seq, Transition: transition, Service: service}:
+	default:
+		log.Println("Dropping event for slow listener:", id, l.seq)
+	}
+}
+
+// Tell every listener about a change to an entry.
+func notifyListeners(listeners map[string]*listener_state, before *entry_state, after *entry_state) {
+	for id, l := range listeners {
+		notifyListener(id, l, before, after)
+	}
+}
+
+// Has anything other than the lease changed on the Service?
+func attributesChanged(before Service, after Service) bool {
+	return before.Data != after.Data || before.ID != after.ID || !reflect.DeepEqual(before.Keys, after.Keys) || !reflect.DeepEqual(before.Groups, after.Groups)
+}
+
+// Creates the listener and starts the goroutine that delivers its events. Closing the events chan stops delivery.
+func newListener(t template, callback string, expiry time.Time, token string) *listener_state {
+	l := &listener_state{template: t, callback: callback, expiry: expiry, events: make(chan Event, event_queue_size), token: token}
+	go deliverEvents(l.callback, l.events)
+	return l
+}
+
+// POST each event in turn to the callback URL. Events that fail to be delivered are dropped; the receiver can see the gap in the
+// sequence numbers.
+func deliverEvents(callback string, events chan Event) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for e := range events {
+		b, _ := json.Marshal(e)
+		resp, err := client.Post(callback, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			log.Println("Unable to deliver event:", callback, e.Seq, err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// Remove any listeners whose lease has expired and stop delivering their events.
+func removeStaleListeners(listeners map[string]*listener_state) {
+	now := time.Now()
+	for id, l := range listeners {
+		if !now.Before(l.expiry) {
+			close(l.events)
+			delete(listeners, id)
+		}
+	}
+}
+
+// Extract the Notify_request that was passed over the wire as JSON from the http.Request.
+func getNotifyRequest(w http.ResponseWriter, r *http.Request) (Notify_request, *Error) {
+	var n Notify_request
+	err := readJSON(w, r, &n)
+	if err != nil {
+		return n, err
+	}
+	err = validateCallback(n.Callback)
+	if err != nil {
+		return n, err
+	}
+	return n, validateLease(n.Lease)
+}
+
+// The wrapper func that is called when clients want to register for events (POST) or renew their notify registration (PUT).
+func Notify(request_channel chan Request, urls *Advertised_urls, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	response_chan := make(chan response)
+	if r.Method == "POST" {
+		n, err := getNotifyRequest(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		t, query_err := newTemplate(n.Keys, n.Groups, n.Query)
+		if query_err != nil {
+			writeError(w, badRequest(query_err.Error()).with("Query", n.Query))
+			return
+		}
+		t.visible = accessFor(r).visible()
+		request_channel <- Request{q: "notify", response_channel: response_chan, service: Service{Lease: n.Lease}, template: t, callback: n.Callback}
+	} else if r.Method == "PUT" {
+		path := r.URL.Path
+		id := path[len(Notify_url()):len(path)]
+		service, err := getService(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		request_channel <- Request{q: "renew_notify", response_channel: response_chan, service: service, id: id, token: r.Header.Get(Lease_token_header)}
+	} else {
+		methodNotAllowed(w, "POST, PUT")
+		return
+	}
+	response := <-response_chan
+	if response.id == "" {
+		writeError(w, newError(http.StatusNotFound, Code_lease_expired, "The lease has expired"))
+		return
+	}
+	if e, ok := response.err.(*Error); ok {
+		writeError(w, e)
+		return
+	}
+	b, _ := json.Marshal(Registration{Url: urls.For(r, Notify_url()+response.id), Lease: response.lease, Policy: response.policy, Token: response.token})
+	w.Write(b)
+}
+
+// Returns an http.HandlerFunc that clients can mount at their callback URL. Every Event that arrives is passed on to the chan.
+func NewEventHandler(events chan Event) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		body, _ := ioutil.ReadAll(r.Body)
+		err := json.Unmarshal(body, &e)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- e
+	}
+}
+
+// Helper func to allow us to replace all the notify urls easily.
+func Notify_url() string {
+	return "/notify/"
+}
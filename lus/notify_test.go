@@ -0,0 +1,79 @@
+package lus
+
+/**
+  Test that listeners are told about the right transitions.
+**/
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyTransitions(t *testing.T) {
+	l := &listener_state{template: template{keys: map[string]string{"environment": "prod"}}, events: make(chan Event, 10)}
+	prod := entry_state{service: Service{ID: "a", Keys: map[string]string{"environment": "prod"}}}
+	prod_changed := entry_state{service: Service{ID: "a", Data: "draining", Keys: map[string]string{"environment": "prod"}}}
+	dev := entry_state{service: Service{ID: "a", Keys: map[string]string{"environment": "dev"}}}
+
+	notifyListener("l", l, nil, &prod)
+	notifyListener("l", l, &prod, &prod)
+	notifyListener("l", l, &prod, &prod_changed)
+	notifyListener("l", l, &prod_changed, &dev)
+	notifyListener("l", l, &dev, nil)
+
+	assert_event(t, <-l.events, 1, TransitionNoMatchMatch)
+	assert_event(t, <-l.events, 2, TransitionMatchMatch)
+	assert_event(t, <-l.events, 3, TransitionMatchNoMatch)
+	if len(l.events) != 0 {
+		t.Fatalf("Expected no more events but got %v", len(l.events))
+	}
+}
+
+// Test that events make it all the way to a callback url. Needs the lus_server to be running.
+func TestClientNotify(t *testing.T) {
+	events := make(chan Event, 10)
+	callback := httptest.NewServer(NewEventHandler(events))
+	defer callback.Close()
+
+	client := must_client(t, root_url())
+	n := must_notify(t, client, map[string]string{"application": "notified"}, callback.URL, 10000)
+	defer client.Renew(context.Background(), n.Url, 0)
+
+	b := must_register(t, client, NewService(map[string]string{"application": "notified"}, 10000, "", "n123"))
+	assert_event(t, wait_for_event(t, events), 1, TransitionNoMatchMatch)
+	client.Renew(context.Background(), b.Url, 0)
+	e := wait_for_event(t, events)
+	assert_event(t, e, 2, TransitionMatchNoMatch)
+	assert_id(e.Service, "n123")
+}
+
+// Test that a callback that events couldn't be POSTed to is turned away.
+func TestNotifyCallback(t *testing.T) {
+	client := must_client(t, start_test_lus(t, Options{MaxLease: 60000}))
+	for _, callback := range []string{"", "/events", "localhost:8080/events", "ftp://example.com/events", "http:///events", "http://%zz"} {
+		_, err := client.Notify(context.Background(), map[string]string{"application": "notified"}, callback, 10000)
+		if !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("Expected the callback %q to be turned down but got %v", callback, err)
+		}
+	}
+	must_notify(t, client, map[string]string{"application": "notified"}, "https://example.com/events", 10000)
+}
+
+func wait_for_event(t *testing.T, events chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return Event{}
+}
+
+func assert_event(t *testing.T, e Event, seq int64, transition string) {
+	if e.Seq != seq || e.Transition != transition {
+		t.Fatalf("Event %v/%v is different to assertion %v/%v", e.Seq, e.Transition, seq, transition)
+	}
+}
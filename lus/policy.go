@@ -0,0 +1,240 @@
+package lus
+
+/**
+  Lease policies. Rather than every lease being capped by the single maximum lease, the LUS can be given a policy file (JSON)
+  that decides how long a lease to grant e.g.
+
+      {
+          "Max": 120000, "Min": 1000, "Default": 30000, "MinRenewInterval": 500,
+          "Capacity": 100000, "MaxRate": 5000, "ShrinkAt": 0.8,
+          "Rules": [
+              {"Name": "prod", "Match": {"env": "prod"}, "Max": 600000, "Min": 5000},
+              {"Name": "batch", "Match": {"application": "batch-*"}, "Max": 10000}
+          ]
+      }
+
+  The first rule whose Match patterns (see path.Match) all match the keys of a Service sets its Min, Max and Default, falling
+  back on the top level ones for anything the rule leaves out. A registration that asks for a zero lease gets the Default. Once
+  the registry holds more than ShrinkAt of its Capacity, or more than ShrinkAt of MaxRate registrations and renewals are arriving
+  each second, granted leases are shrunk towards the Min so that clients check in more often while things are busy. A renewal
+  that comes sooner than MinRenewInterval after the last one is turned away with a 429.
+
+  The policy that was applied is sent back in the Registration so that a client can see why it got the lease it did.
+**/
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// The load at which leases start to shrink if the policy doesn't say.
+const default_shrink_at = 0.8
+
+// Represents the JSON data struct of a lease policy file.
+type Lease_policy struct {
+	Default          int64   // The lease in ms for a registration that asks for 0. If 0 then it gets a zero lease
+	Min              int64   // The shortest lease in ms that will be granted
+	Max              int64   // The longest lease in ms that will be granted. If 0 then the maximum lease of the LUS is used
+	MinRenewInterval int64   // How long in ms an entry must wait between renewals
+	Capacity         int     // How many entries the registry is meant to hold. 0 means no limit
+	MaxRate          int     // How many registrations and renewals a second the LUS is meant to handle. 0 means no limit
+	ShrinkAt         float64 // The load (0-1) at which leases start to shrink. Defaults to 0.8
+	Rules            []Lease_rule
+}
+
+// The leases for the Services whose keys match.
+type Lease_rule struct {
+	Name    string
+	Match   map[string]string // Key to a path.Match pattern for its value
+	Default int64
+	Min     int64
+	Max     int64
+}
+
+// Represents the JSON data struct for the policy that was applied to a lease.
+type Applied_policy struct {
+	Rule             string `json:",omitempty"` // The rule that matched, if any
+	Requested        int64  // The lease that was asked for in ms
+	Min              int64
+	Max              int64
+	Load             float64 `json:",omitempty"` // How busy the LUS was (0-1). Leases shrink once this goes over the ShrinkAt of the policy
+	MinRenewInterval int64   `json:",omitempty"`
+}
+
+// Reads a lease policy from a JSON file.
+func LoadLeasePolicy(file string) (*Lease_policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Lease_policy{}
+	err = json.Unmarshal(b, policy)
+	if err != nil {
+		return nil, errors.New("policy: " + file + " is not valid JSON: " + err.Error())
+	}
+	return policy, policy.Validate()
+}
+
+// Check that the policy makes sense.
+func (policy *Lease_policy) Validate() error {
+	if policy.Default < 0 || policy.Min < 0 || policy.Max < 0 || policy.MinRenewInterval < 0 || policy.Capacity < 0 || policy.MaxRate < 0 {
+		return errors.New("policy: leases, intervals and limits can't be negative")
+	}
+	if policy.Max > 0 && policy.Min > policy.Max {
+		return errors.New("policy: Min is greater than Max")
+	}
+	if policy.ShrinkAt < 0 || policy.ShrinkAt >= 1 {
+		return errors.New("policy: ShrinkAt must be between 0 and 1")
+	}
+	for _, rule := range policy.Rules {
+		if rule.Default < 0 || rule.Min < 0 || rule.Max < 0 {
+			return errors.New("policy: the leases in rule " + rule.Name + " can't be negative")
+		}
+		if rule.Max > 0 && rule.Min > rule.Max {
+			return errors.New("policy: Min is greater than Max in rule " + rule.Name)
+		}
+		for k, pattern := range rule.Match {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return errors.New("policy: the pattern for " + k + " in rule " + rule.Name + " is not valid: " + pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Does the rule match the keys?
+func (rule Lease_rule) matches(keys map[string]string) bool {
+	return rule.Match == nil || keysMatch(rule.Match, keys)
+}
+
+// The longest lease that will be granted to a Service with the keys.
+func (policy *Lease_policy) maxFor(keys map[string]string) int64 {
+	_, applied := policy.grant(keys, math.MaxInt64, false, 0)
+	return applied.Max
+}
+
+// The lease to grant for a request of requested ms from a Service with the keys when the LUS is at the load. A zero request on
+// a registration gets the default.
+func (policy *Lease_policy) grant(keys map[string]string, requested int64, register bool, load float64) (int64, Applied_policy) {
+	applied := Applied_policy{Requested: requested, Min: policy.Min, Max: policy.Max, MinRenewInterval: policy.MinRenewInterval}
+	def := policy.Default
+	for _, rule := range policy.Rules {
+		if rule.matches(keys) {
+			applied.Rule = rule.Name
+			if rule.Min > 0 {
+				applied.Min = rule.Min
+			}
+			if rule.Max > 0 {
+				applied.Max = rule.Max
+			}
+			if rule.Default > 0 {
+				def = rule.Default
+			}
+			break
+		}
+	}
+	if applied.Min > applied.Max {
+		applied.Min = applied.Max
+	}
+
+	lease := requested
+	if lease == 0 && register {
+		lease = def
+	}
+	if lease == 0 {
+		return 0, applied
+	}
+	lease = int64(math.Max(math.Min(float64(lease), float64(applied.Max)), float64(applied.Min)))
+
+	shrink_at := policy.ShrinkAt
+	if shrink_at == 0 {
+		shrink_at = default_shrink_at
+	}
+	if load > shrink_at {
+		applied.Load = math.Min(load, 1)
+		shrunk := int64(float64(lease) * (1 - applied.Load) / (1 - shrink_at))
+		if shrunk < lease {
+			lease = int64(math.Max(float64(shrunk), float64(applied.Min)))
+		}
+	}
+	return lease, applied
+}
+
+// Internal struct owned by the lus goroutine that applies the policy and keeps track of how busy the LUS is.
+type policy_state struct {
+	policy   *Lease_policy
+	requests int // Registrations and renewals since the last tick
+	rate     int // Registrations and renewals in the last second
+}
+
+// Creates the policy state from the Options. A LUS without a policy just caps leases at the maximum lease.
+func newPolicyState(options Options) *policy_state {
+	policy := Lease_policy{}
+	if options.Policy != nil {
+		policy = *options.Policy
+	}
+	if policy.Max == 0 {
+		policy.Max = int64(options.MaxLease)
+	}
+	return &policy_state{policy: &policy}
+}
+
+// Use the policy (and MaxLease) from the options from now on. What the LUS has seen of the request rate is kept.
+func (ps *policy_state) reconfigure(options Options) {
+	ps.policy = newPolicyState(options).policy
+}
+
+// Change the lease policy of a running LUS. Only the Policy and MaxLease in the options are used; the rest can only be set when
+// the LUS is started. Leases that have already been granted are left alone.
+func Reconfigure(request_channel chan Request, options Options) {
+	response_chan := make(chan response)
+	request_channel <- Request{q: "reconfigure", response_channel: response_chan, options: options}
+	<-response_chan
+}
+
+// How busy the LUS is, from 0 to 1 (or more if it is over its limits).
+func (ps *policy_state) load(entries int) float64 {
+	load := 0.0
+	if ps.policy.Capacity > 0 {
+		load = float64(entries) / float64(ps.policy.Capacity)
+	}
+	if ps.policy.MaxRate > 0 {
+		rate := ps.rate
+		if ps.requests > rate {
+			rate = ps.requests
+		}
+		load = math.Max(load, float64(rate)/float64(ps.policy.MaxRate))
+	}
+	return load
+}
+
+// Grant a lease for a request from a Service that is being registered or renewed (or, with no keys, for a listener or renewal set).
+func (ps *policy_state) grant(service Service, register bool, entries int) (time.Time, int64, *Applied_policy) {
+	ps.requests++
+	lease, applied := ps.policy.grant(service.Keys, service.Lease, register, ps.load(entries))
+	return time.Now().Add(time.Duration(lease) * time.Millisecond), lease, &applied
+}
+
+// Is it too soon to renew an entry that was last granted a lease at the time? Returns how long it has to wait.
+func (ps *policy_state) tooSoon(granted time.Time, now time.Time) (time.Duration, bool) {
+	wait := granted.Add(time.Duration(ps.policy.MinRenewInterval) * time.Millisecond).Sub(now)
+	return wait, ps.policy.MinRenewInterval > 0 && wait > 0
+}
+
+// Called every tick (second) to keep track of the rate of requests.
+func (ps *policy_state) tick() {
+	ps.rate, ps.requests = ps.requests, 0
+}
+
+// Tell a client that it is renewing too often.
+func renewingTooSoon(wait time.Duration) *Error {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	return newError(http.StatusTooManyRequests, Code_too_many_requests, "The entry was renewed too recently").with("Retry-After", strconv.FormatInt(seconds, 10))
+}
@@ -0,0 +1,92 @@
+package lus
+
+/**
+  Test that lease policies pick the right rule, fill in defaults, shrink leases under load and stop entries renewing too often.
+**/
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var test_policy = &Lease_policy{
+	Default: 30000,
+	Min:     1000,
+	Max:     120000,
+	Rules: []Lease_rule{
+		{Name: "prod", Match: map[string]string{"env": "prod"}, Min: 5000, Max: 600000},
+		{Name: "batch", Match: map[string]string{"application": "batch-*"}, Max: 10000, Default: 2000},
+	},
+}
+
+func TestLeasePolicy(t *testing.T) {
+	tests := []struct {
+		keys      map[string]string
+		requested int64
+		register  bool
+		load      float64
+		lease     int64
+		rule      string
+	}{
+		{map[string]string{"env": "dev"}, 500000, true, 0, 120000, ""},
+		{map[string]string{"env": "prod"}, 500000, true, 0, 500000, "prod"},
+		{map[string]string{"env": "prod"}, 100, true, 0, 5000, "prod"},
+		{map[string]string{"env": "dev"}, 0, true, 0, 30000, ""},
+		{map[string]string{"application": "batch-nightly"}, 0, true, 0, 2000, "batch"},
+		{map[string]string{"application": "batch-nightly"}, 0, false, 0, 0, "batch"},
+		{map[string]string{"application": "batch-nightly"}, 60000, true, 0, 10000, "batch"},
+		{map[string]string{"env": "dev"}, 100000, true, 0.9, 50000, ""},
+		{map[string]string{"env": "dev"}, 100000, true, 2, 1000, ""},
+	}
+	for _, test := range tests {
+		lease, applied := test_policy.grant(test.keys, test.requested, test.register, test.load)
+		if lease != test.lease || applied.Rule != test.rule || applied.Requested != test.requested {
+			t.Fatalf("Expected %v to be granted %v by %q but got %v %+v", test.keys, test.lease, test.rule, lease, applied)
+		}
+	}
+	if max := test_policy.maxFor(map[string]string{"env": "prod"}); max != 600000 {
+		t.Fatalf("Expected the prod rule to allow longer leases but got %v", max)
+	}
+}
+
+func TestLoadLeasePolicy(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	ioutil.WriteFile(good, []byte(`{"Max": 60000, "Rules": [{"Name": "prod", "Match": {"env": "prod"}, "Max": 120000}]}`), 0644)
+	policy, err := LoadLeasePolicy(good)
+	if err != nil || policy.Max != 60000 || len(policy.Rules) != 1 {
+		t.Fatalf("Expected the policy to load but got %+v %v", policy, err)
+	}
+
+	for name, contents := range map[string]string{
+		"json":    `{"Max": `,
+		"minmax":  `{"Min": 2000, "Max": 1000}`,
+		"pattern": `{"Rules": [{"Name": "broken", "Match": {"env": "[prod"}}]}`,
+		"shrink":  `{"ShrinkAt": 1.5}`,
+	} {
+		file := filepath.Join(dir, name+".json")
+		ioutil.WriteFile(file, []byte(contents), 0644)
+		if _, err := LoadLeasePolicy(file); err == nil {
+			t.Fatalf("Expected the %v policy to be rejected", name)
+		}
+	}
+}
+
+func TestPolicyInRegistration(t *testing.T) {
+	root := start_test_lus(t, Options{MaxLease: 60000, Policy: &Lease_policy{MinRenewInterval: 60000, Rules: test_policy.Rules}})
+	client := must_client(t, root)
+
+	r := must_register(t, client, NewService(map[string]string{"env": "prod"}, 100, "", "prod123"))
+	if r.Lease != 5000 || r.Policy == nil || r.Policy.Rule != "prod" || r.Policy.Requested != 100 {
+		t.Fatalf("Expected the prod rule to be reported back but got %+v %+v", r, r.Policy)
+	}
+	if _, err := client.Renew(context.Background(), r.Url, 10000); !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("Expected a renewal straight after registering to be turned away but got %v", err)
+	}
+	if _, err := client.Renew(context.Background(), r.Url, 0); err != nil {
+		t.Fatalf("Expected a client to always be able to give up its lease but got %v", err)
+	}
+}
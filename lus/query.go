@@ -0,0 +1,549 @@
+package lus
+
+/**
+  A small query language for /find that goes beyond exact key/value matching. A query is made up of clauses joined with and/or,
+  optionally negated with not and grouped with brackets e.g.
+
+    env in [prod,staging] and (version >= v1.2.0 or has canary) and not host like "test-*"
+
+  The clauses are:
+    has key           the key is present
+    key = value       exact match                key != value   present but different
+    key ^= value      value is a prefix          key like glob  glob match where * is any run of chars and ? is any one char
+    key ~ regex       regular expression match   key in [a,b]   one of the values
+    key < value       also <=, > and >=. Compared as numbers, or as semantic versions if the value starts with a v (e.g. v1.2.0)
+
+  Values that contain spaces or any of ()[],=!^<>~" must be double quoted. Apart from has (and anything inside a not) a clause
+  never matches an entry that doesn't have the key. Queries are sent to /find in the Query field and can be built up in a type
+  safe way with Key, And, Or and Not.
+**/
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Internal interface for a parsed query.
+type query_expr interface {
+	matches(e entry_state) bool
+}
+
+type or_expr []query_expr
+type and_expr []query_expr
+type not_expr struct{ expr query_expr }
+
+// A single clause of a query.
+type clause struct {
+	key    string
+	op     string
+	values []string
+	re     *regexp.Regexp // For like and ~
+	number float64        // For numeric comparisons
+	semver []int64        // For semver comparisons
+	pre    string         // The pre-release part of semver
+}
+
+func (q or_expr) matches(e entry_state) bool {
+	for _, expr := range q {
+		if expr.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q and_expr) matches(e entry_state) bool {
+	for _, expr := range q {
+		if !expr.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q not_expr) matches(e entry_state) bool {
+	return !q.expr.matches(e)
+}
+
+func (c *clause) matches(e entry_state) bool {
+	v, ok := e.service.Keys[c.key]
+	if c.op == "has" || !ok {
+		return ok
+	}
+	switch c.op {
+	case "=":
+		return v == c.values[0]
+	case "!=":
+		return v != c.values[0]
+	case "^=":
+		return strings.HasPrefix(v, c.values[0])
+	case "like", "~":
+		return c.re.MatchString(v)
+	case "in":
+		for _, value := range c.values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	// Must be a comparison
+	var cmp int
+	if c.semver != nil {
+		semver, pre, ok := parseSemver(v)
+		if !ok {
+			return false
+		}
+		cmp = compareSemver(semver, pre, c.semver, c.pre)
+	} else {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case n < c.number:
+			cmp = -1
+		case n > c.number:
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// Parse a query. An empty query is nil and matches everything.
+func parseQuery(query string) (query_expr, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &query_parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+// A token is either a word, a quoted string or a bit of punctuation/an operator.
+type query_token struct {
+	text   string
+	quoted bool
+	punct  bool
+	at     int
+}
+
+const query_punct = "()[],=!^<>~\""
+
+func lexQuery(query string) ([]query_token, error) {
+	tokens := []query_token{}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(query) && query[j] != '"'; j++ {
+				if query[j] == '\\' && j+1 < len(query) {
+					j++
+				}
+				b.WriteByte(query[j])
+			}
+			if j >= len(query) {
+				return nil, fmt.Errorf("query: unterminated string at %d", i)
+			}
+			tokens = append(tokens, query_token{text: b.String(), quoted: true, at: i})
+			i = j + 1
+		case strings.IndexByte("()[],", c) >= 0 || c == '~':
+			tokens = append(tokens, query_token{text: string(c), punct: true, at: i})
+			i++
+		case strings.IndexByte("=!^<>", c) >= 0:
+			op := string(c)
+			if i+1 < len(query) && query[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" || op == "^" {
+				return nil, fmt.Errorf("query: unknown operator %q at %d", op, i)
+			}
+			tokens = append(tokens, query_token{text: op, punct: true, at: i})
+			i += len(op)
+		default:
+			j := i
+			for j < len(query) && strings.IndexByte(query_punct+" \t\n", query[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, query_token{text: query[i:j], at: i})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type query_parser struct {
+	tokens []query_token
+	pos    int
+}
+
+func (p *query_parser) errorf(format string, args ...interface{}) error {
+	at := -1
+	if p.pos < len(p.tokens) {
+		at = p.tokens[p.pos].at
+	}
+	return fmt.Errorf("query: "+format+" at %d", append(args, at)...)
+}
+
+// Is the next token the supplied keyword (case insensitive) or punctuation?
+func (p *query_parser) peekIs(text string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+	return strings.EqualFold(p.tokens[p.pos].text, text)
+}
+
+func (p *query_parser) expect(text string) error {
+	if !p.peekIs(text) {
+		return p.errorf("expected %q", text)
+	}
+	p.pos++
+	return nil
+}
+
+// A key or value must be a word or a quoted string.
+func (p *query_parser) word() (string, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].punct {
+		return "", p.errorf("expected a key or value")
+	}
+	p.pos++
+	return p.tokens[p.pos-1].text, nil
+}
+
+func (p *query_parser) parseOr() (query_expr, error) {
+	exprs := or_expr{}
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.peekIs("or") {
+			break
+		}
+		p.pos++
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *query_parser) parseAnd() (query_expr, error) {
+	exprs := and_expr{}
+	for {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.peekIs("and") {
+			break
+		}
+		p.pos++
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *query_parser) parseUnary() (query_expr, error) {
+	if p.peekIs("not") {
+		p.pos++
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not_expr{expr}, nil
+	}
+	if p.peekIs("(") {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	return p.parseClause()
+}
+
+func (p *query_parser) parseClause() (query_expr, error) {
+	if p.peekIs("has") {
+		p.pos++
+		key, err := p.word()
+		return &clause{key: key, op: "has"}, err
+	}
+	key, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return nil, p.errorf("expected an operator")
+	}
+	c := &clause{key: key, op: strings.ToLower(p.tokens[p.pos].text)}
+	p.pos++
+
+	switch c.op {
+	case "in":
+		err = p.expect("[")
+		for err == nil && !p.peekIs("]") {
+			var value string
+			value, err = p.word()
+			c.values = append(c.values, value)
+			if err == nil && !p.peekIs("]") {
+				err = p.expect(",")
+			}
+		}
+		if err == nil {
+			err = p.expect("]")
+		}
+		return c, err
+	case "=", "!=", "^=", "like", "~", "<", "<=", ">", ">=":
+	default:
+		p.pos--
+		return nil, p.errorf("unknown operator %q", c.op)
+	}
+
+	value, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	c.values = []string{value}
+	switch c.op {
+	case "like":
+		c.re, err = regexp.Compile("^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(value)) + "$")
+	case "~":
+		c.re, err = regexp.Compile(value)
+	case "<", "<=", ">", ">=":
+		if strings.HasPrefix(value, "v") {
+			var ok bool
+			c.semver, c.pre, ok = parseSemver(value)
+			if !ok {
+				err = fmt.Errorf("query: %q is not a semantic version", value)
+			}
+		} else {
+			c.number, err = strconv.ParseFloat(value, 64)
+		}
+	}
+	return c, err
+}
+
+// Parse a semantic version such as v1.2.3-rc.1+build (the v and any missing minor/patch parts are optional). Build metadata
+// is ignored.
+func parseSemver(v string) ([]int64, string, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	pre := ""
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return nil, "", false
+	}
+	semver := make([]int64, 3)
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		semver[i] = n
+	}
+	return semver, pre, true
+}
+
+// Compare two semantic versions returning -1, 0 or 1. A pre-release comes before the release itself.
+func compareSemver(a []int64, a_pre string, b []int64, b_pre string) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case a_pre == b_pre:
+		return 0
+	case a_pre == "":
+		return 1
+	case b_pre == "":
+		return -1
+	}
+	return comparePrerelease(strings.Split(a_pre, "."), strings.Split(b_pre, "."))
+}
+
+// Compare the dot separated identifiers of two pre-releases (see https://semver.org/#spec-item-11). Numeric identifiers are
+// compared by value and come before alphanumeric ones, which are compared as strings. If one runs out first then it comes first.
+func comparePrerelease(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		a_numeric, b_numeric := isNumeric(a[i]), isNumeric(b[i])
+		switch {
+		case a[i] == b[i]:
+			continue
+		case a_numeric && !b_numeric:
+			return -1
+		case !a_numeric && b_numeric:
+			return 1
+		case a_numeric && len(a[i]) != len(b[i]): // Without leading zeros the longer number is the bigger one
+			if len(a[i]) < len(b[i]) {
+				return -1
+			}
+			return 1
+		case a[i] < b[i]:
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func isNumeric(identifier string) bool {
+	for _, c := range identifier {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return identifier != ""
+}
+
+// A query that can be sent to find. Build one with Key, And, Or and Not, or use ParseQuery for a query written by hand.
+type Query struct {
+	expr string
+}
+
+// The query in the form that is sent over the wire.
+func (q Query) String() string {
+	return q.expr
+}
+
+// Check that a query written by hand is valid.
+func ParseQuery(query string) (Query, error) {
+	_, err := parseQuery(query)
+	return Query{expr: query}, err
+}
+
+// Builds clauses on a key.
+type Key_query struct {
+	key string
+}
+
+// Start building a clause on the key.
+func Key(key string) Key_query {
+	return Key_query{key: key}
+}
+
+func (k Key_query) clause(op string, value string) Query {
+	return Query{expr: quoteQuery(k.key) + " " + op + " " + quoteQuery(value)}
+}
+
+// Clauses that compare the value of the key with a string.
+func (k Key_query) Exists() Query                 { return Query{expr: "has " + quoteQuery(k.key)} }
+func (k Key_query) Equals(value string) Query     { return k.clause("=", value) }
+func (k Key_query) NotEquals(value string) Query  { return k.clause("!=", value) }
+func (k Key_query) HasPrefix(prefix string) Query { return k.clause("^=", prefix) }
+func (k Key_query) Like(glob string) Query        { return k.clause("like", glob) }
+func (k Key_query) Matches(regex string) Query    { return k.clause("~", regex) }
+
+// The value of the key must be one of the values.
+func (k Key_query) In(values ...string) Query {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteQuery(v)
+	}
+	return Query{expr: quoteQuery(k.key) + " in [" + strings.Join(quoted, ",") + "]"}
+}
+
+// Numeric comparisons.
+func (k Key_query) LessThan(n float64) Query    { return k.clause("<", formatNumber(n)) }
+func (k Key_query) AtMost(n float64) Query      { return k.clause("<=", formatNumber(n)) }
+func (k Key_query) GreaterThan(n float64) Query { return k.clause(">", formatNumber(n)) }
+func (k Key_query) AtLeast(n float64) Query     { return k.clause(">=", formatNumber(n)) }
+
+// Semantic version comparisons. The version can be supplied with or without a leading v.
+func (k Key_query) VersionBefore(version string) Query { return k.clause("<", semverLiteral(version)) }
+func (k Key_query) VersionAtMost(version string) Query { return k.clause("<=", semverLiteral(version)) }
+func (k Key_query) VersionAfter(version string) Query  { return k.clause(">", semverLiteral(version)) }
+func (k Key_query) VersionAtLeast(version string) Query {
+	return k.clause(">=", semverLiteral(version))
+}
+
+// Every one of the queries must match.
+func And(queries ...Query) Query {
+	return join(queries, " and ")
+}
+
+// Any one of the queries must match.
+func Or(queries ...Query) Query {
+	return join(queries, " or ")
+}
+
+// The query must not match.
+func Not(query Query) Query {
+	return Query{expr: "not (" + query.expr + ")"}
+}
+
+func join(queries []Query, with string) Query {
+	exprs := make([]string, len(queries))
+	for i, q := range queries {
+		exprs[i] = "(" + q.expr + ")"
+	}
+	return Query{expr: strings.Join(exprs, with)}
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func semverLiteral(version string) string {
+	if strings.HasPrefix(version, "v") {
+		return version
+	}
+	return "v" + version
+}
+
+// Quote a key or value if it isn't a plain word (or could be mistaken for a keyword).
+func quoteQuery(s string) string {
+	switch strings.ToLower(s) {
+	case "and", "or", "not", "has", "in", "like", "":
+		return `"` + s + `"`
+	}
+	if strings.ContainsAny(s, query_punct+" \t\n\\") {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return s
+}
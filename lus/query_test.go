@@ -0,0 +1,103 @@
+package lus
+
+/**
+  Test the find query language and its builder.
+**/
+
+import (
+	"testing"
+)
+
+func TestQueries(t *testing.T) {
+	e := entry_state{service: Service{Keys: map[string]string{"env": "prod", "version": "1.10.0", "load": "0.75", "host": "web-01.example.com", "name": "and"}}}
+	queries := map[string]bool{
+		`env = prod`:                            true,
+		`env != prod`:                           false,
+		`env in [staging, prod]`:                true,
+		`env in [dev]`:                          false,
+		`has version and not has canary`:        true,
+		`host ^= web-`:                          true,
+		`host like "web-??.*"`:                  true,
+		`host like web-*.example.org`:           false,
+		`host ~ "^web-[0-9]+\\."`:               true,
+		`version >= v1.9.0`:                     true,
+		`version < v1.10.0-rc.1`:                false,
+		`version > v1.10.0-rc.1`:                true,
+		`load < 1 and load >= 0.75`:             true,
+		`load > 1 or env = prod`:                true,
+		`(load > 1 or env = dev) and has env`:   false,
+		`missing != prod`:                       false,
+		`not missing = prod`:                    true,
+		`"name" = "and" AND NOT (env = "dev")`:  true,
+		`env = prod or env = dev and load > 10`: true, // and binds tighter than or
+	}
+	for q, expected := range queries {
+		expr, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("Unable to parse %v: %v", q, err)
+		}
+		if expr.matches(e) != expected {
+			t.Fatalf("Query %v should have been %v", q, expected)
+		}
+	}
+
+	for _, q := range []string{`env =`, `env in [prod`, `(env = prod`, `env ! prod`, `version > v1.x`, `load > high`, `env = "prod`, `env prod`} {
+		_, err := parseQuery(q)
+		if err == nil {
+			t.Fatalf("Expected %v to fail to parse", q)
+		}
+	}
+}
+
+// Test that pre-releases are ordered as in https://semver.org/#spec-item-11
+func TestSemverPrerelease(t *testing.T) {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0"}
+	for i := range ordered {
+		for j := range ordered {
+			a, a_pre, _ := parseSemver(ordered[i])
+			b, b_pre, _ := parseSemver(ordered[j])
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if cmp := compareSemver(a, a_pre, b, b_pre); cmp != expected {
+				t.Fatalf("Expected %v compared to %v to be %v but got %v", ordered[i], ordered[j], expected, cmp)
+			}
+		}
+	}
+
+	e := entry_state{service: Service{Keys: map[string]string{"version": "2.0.0-rc.10"}}}
+	for q, expected := range map[string]bool{`version > v2.0.0-rc.2`: true, `version < v2.0.0-rc.2`: false, `version < v2.0.0-rc.10.1`: true} {
+		expr, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("Unable to parse %v: %v", q, err)
+		}
+		if expr.matches(e) != expected {
+			t.Fatalf("Query %v should have been %v", q, expected)
+		}
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	q := And(Key("env").In("prod", "staging area"), Or(Key("version").VersionAtLeast("1.2.0"), Key("canary").Exists()), Not(Key("name").Equals("and")))
+	expected := `(env in [prod,"staging area"]) and ((version >= v1.2.0) or (has canary)) and (not (name = "and"))`
+	assert_strings_match(expected, q.String())
+	_, err := ParseQuery(q.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that queries can be sent through the Client.
+func TestClientFindWhere(t *testing.T) {
+	client := must_client(t, start_test_lus(t, Options{MaxLease: 60000}))
+	must_register(t, client, NewService(map[string]string{"application": "queried", "version": "1.2.0"}, 10000, "", "a"))
+	must_register(t, client, NewService(map[string]string{"application": "queried", "version": "2.0.0"}, 10000, "", "b"))
+
+	found := must_find_where(t, client, And(Key("application").HasPrefix("quer"), Key("version").VersionAtLeast("v1.5")))
+	assert_num_entries("found", found, 1)
+	assert_id(found[0], "b")
+	assert_num_entries("map", must_find(t, client, map[string]string{"application": "queried"}), 2)
+}
@@ -0,0 +1,164 @@
+package lus
+
+/**
+  The state that is owned by the core lus goroutine. Every change to the entries goes through put, cancel, merge, expire or tick so that
+  the store, the listeners, the watches and the per entry versions that peers gossip about are all kept in step.
+**/
+
+import (
+	"log"
+	"time"
+)
+
+// How many ticks (seconds) between snapshots of the entries to the Store.
+const snapshot_ticks = 60
+
+// Internal struct that is left behind when an entry is cancelled so that a peer with an older copy can't bring it back. Once
+// the entry would have expired anyway the tombstone is no longer needed as any copy will have expired too.
+type tombstone struct {
+	version int64
+	until   time.Time
+}
+
+// Internal struct holding everything that the lus goroutine owns.
+type registry struct {
+	entries      map[string]entry_state
+	tombstones   map[string]tombstone
+	listeners    map[string]*listener_state
+	renewal_sets map[string]*renewal_set
+	watches      *watch_state
+	index        attribute_index
+	expiries     *expiry_heap
+	store        Store
+	ticks        int
+	dirty        bool // Has anything been appended to the store since the last snapshot?
+	metrics      lus_metrics
+}
+
+func newRegistry(entries map[string]entry_state, store Store) *registry {
+	index := make(attribute_index)
+	expiries := newExpiryHeap()
+	for id, e := range entries {
+		index.add(id, e.service.Keys)
+		expiries.schedule(id, e.expiry)
+	}
+	return &registry{
+		entries:      entries,
+		tombstones:   make(map[string]tombstone),
+		listeners:    make(map[string]*listener_state),
+		renewal_sets: make(map[string]*renewal_set),
+		watches:      newWatchState(),
+		index:        index,
+		expiries:     expiries,
+		store:        store,
+		metrics:      newLusMetrics(),
+	}
+}
+
+// Is the ID already being used for an entry, a listener, a renewal set or a tombstone?
+func (reg *registry) inUse(id string) bool {
+	_, entry := reg.entries[id]
+	_, listener := reg.listeners[id]
+	_, set := reg.renewal_sets[id]
+	_, tomb := reg.tombstones[id]
+	return entry || listener || set || tomb
+}
+
+// Adds or replaces an entry.
+func (reg *registry) put(id string, e entry_state) {
+	before, ok := reg.entries[id]
+	reg.entries[id] = e
+	reg.expiries.schedule(id, e.expiry)
+	if ok && !attributesChanged(before.service, e.service) {
+		reg.append(Record{Op: "renew", ID: id, Expiry: e.expiry, Version: e.version})
+		reg.publish(&before, &e)
+		return
+	}
+	reg.append(Record{Op: "register", ID: id, Expiry: e.expiry, Version: e.version, Service: e.service, Token: e.token})
+	if ok {
+		reg.index.remove(id, before.service.Keys)
+	}
+	reg.index.add(id, e.service.Keys)
+	if ok {
+		reg.publish(&before, &e)
+	} else {
+		reg.publish(nil, &e)
+	}
+}
+
+// Extends the lease on an entry, bumping its version.
+func (reg *registry) renew(id string, e entry_state, expiry time.Time) {
+	e.expiry, e.version = expiry, e.version+1
+	reg.put(id, e)
+	reg.metrics.renewals++
+}
+
+// Removes an entry before its lease is up, leaving a tombstone behind for the peers.
+func (reg *registry) cancel(id string) {
+	e, ok := reg.entries[id]
+	if !ok {
+		return
+	}
+	reg.tombstones[id] = tombstone{version: e.version + 1, until: e.expiry}
+	reg.remove(id, e)
+	reg.metrics.cancellations++
+}
+
+func (reg *registry) remove(id string, e entry_state) {
+	delete(reg.entries, id)
+	reg.index.remove(id, e.service.Keys)
+	reg.expiries.unschedule(id)
+	reg.append(Record{Op: "expire", ID: id})
+	reg.publish(&e, nil)
+}
+
+// The Services that match the template.
+func (reg *registry) find(t template) []Service {
+	return findMatchingEntries(t, reg.entries, reg.index)
+}
+
+// Removes the entries whose leases are up.
+func (reg *registry) expire(now time.Time) {
+	for _, id := range reg.expiries.due(now) {
+		reg.remove(id, reg.entries[id])
+		reg.metrics.expirations++
+	}
+}
+
+// Expires stale entries, tombstones and listeners and takes a snapshot if one is due.
+func (reg *registry) tick(now time.Time) {
+	reg.expire(now)
+	for id, t := range reg.tombstones {
+		if !now.Before(t.until) {
+			delete(reg.tombstones, id)
+		}
+	}
+	removeStaleListeners(reg.listeners)
+
+	reg.ticks++
+	if reg.dirty && reg.ticks >= snapshot_ticks {
+		err := reg.store.Snapshot(snapshotRecords(reg.entries))
+		if err != nil {
+			log.Println("Unable to snapshot entries:", err)
+		} else {
+			reg.dirty = false
+		}
+		reg.ticks = 0
+	}
+}
+
+// Writes the record to the store, logging any failure.
+func (reg *registry) append(record Record) {
+	err := reg.store.Append(record)
+	if err != nil {
+		log.Println("Unable to append to store:", record.Op, record.ID, err)
+		return
+	}
+	reg.dirty = true
+}
+
+// Tells the listeners and watches about a change to an entry. A nil before means the entry is new and a nil after means it has gone.
+func (reg *registry) publish(before *entry_state, after *entry_state) {
+	notifyListeners(reg.listeners, before, after)
+	reg.watches.record(before, after)
+}
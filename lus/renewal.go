@@ -0,0 +1,238 @@
+package lus
+
+/**
+  Lease renewal sets, loosely based on the Jini LeaseRenewalService (https://river.apache.org/doc/api/net/jini/lease/LeaseRenewalService.html).
+  Short lived jobs, or anything else that can't keep a goroutine running to renew its leases, can hand them over to the LUS
+  instead. A client POSTs to /renewal to create a renewal set, which has a lease of its own, and then POSTs entry urls to the
+  set along with how long each of them should be kept alive for. The LUS renews the entries itself until that time is up or the
+  set's own lease lapses, whichever comes first, so an abandoned set doesn't keep its entries alive for ever. If the set was
+  created with a Callback then an Expiration_warning is POSTed to it shortly before the set expires, giving the client the chance
+  to renew it.
+
+  Sets are renewed with a PUT, examined with a GET and removed with a DELETE on their url, just like entries. A GET only lists
+  the members that the client may look up. Removing a set leaves its entries to run out their current leases. Sets are not persisted to the store.
+**/
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Represents the JSON data struct that is sent to create a renewal set.
+type Renewal_set_request struct {
+	Lease    int64
+	Callback string `json:",omitempty"` // Where to POST an Expiration_warning
+	Warning  int64  `json:",omitempty"` // How long before the set expires to send the warning in ms. Defaults to half the lease
+}
+
+// Represents the JSON data struct that is POSTed to a renewal set to add an entry to it.
+type Renewal_member_request struct {
+	Url      string // The url of the entry
+	Duration int64  // How long to keep the entry alive for in ms from now. 0 takes it out of the set
+	Token    string // The lease token of the entry, as only its holder can hand it over to a set
+}
+
+// Represents the JSON data struct that is returned from a GET on a renewal set.
+type Renewal_set struct {
+	Lease   int64 // The time left on the lease of the set in ms
+	Members []Renewal_member
+}
+
+// An entry that is kept alive by a renewal set.
+type Renewal_member struct {
+	ID        string
+	Url       string
+	Remaining int64 // How much longer the entry will be kept alive for in ms
+}
+
+// Represents the JSON data struct that is POSTed to the callback url of a renewal set that is about to expire.
+type Expiration_warning struct {
+	Set   string // The ID of the renewal set
+	Lease int64  // The time left on the lease of the set in ms
+}
+
+// Internal struct to track a renewal set.
+type renewal_set struct {
+	expiry   time.Time
+	callback string
+	warning  time.Duration
+	warned   bool
+	token    string               // Hash of the lease token that has to be sent to change the set
+	members  map[string]time.Time // When to stop renewing each entry, by ID
+}
+
+// The earliest of the times.
+func earliest(t time.Time, others ...time.Time) time.Time {
+	for _, o := range others {
+		if o.Before(t) {
+			t = o
+		}
+	}
+	return t
+}
+
+// Renew an entry in the set if it is due, or straight away if forced. An entry is due once it has less than half of the lease
+// left that it could be given under the policy. Returns false if the entry is no longer a member of the set.
+func (reg *registry) renewMember(set *renewal_set, id string, now time.Time, policy *Lease_policy, force bool) bool {
+	until := set.members[id]
+	e, ok := reg.entries[id]
+	if !ok || !now.Before(until) {
+		delete(set.members, id)
+		return false
+	}
+	target := earliest(until, set.expiry, now.Add(time.Duration(policy.maxFor(e.service.Keys))*time.Millisecond))
+	if !target.After(e.expiry) || (!force && e.expiry.Sub(now) >= target.Sub(now)/2) {
+		return true
+	}
+	reg.renew(id, e, target)
+	return true
+}
+
+func (reg *registry) renewMembers(set *renewal_set, now time.Time, policy *Lease_policy, force bool) {
+	for id := range set.members {
+		reg.renewMember(set, id, now, policy, force)
+	}
+}
+
+// Called every tick. Drops the sets whose leases are up, warns the ones that are about to expire and renews the members of the
+// rest.
+func (reg *registry) tickRenewalSets(now time.Time, policy *Lease_policy) {
+	for id, set := range reg.renewal_sets {
+		if !now.Before(set.expiry) {
+			delete(reg.renewal_sets, id)
+			continue
+		}
+		if set.callback != "" && !set.warned && !now.Add(set.warning).Before(set.expiry) {
+			set.warned = true
+			go deliverWarning(set.callback, Expiration_warning{Set: id, Lease: inMilliseconds(set.expiry.Sub(now))})
+		}
+		reg.renewMembers(set, now, policy, false)
+	}
+}
+
+// The Renewal_set for a GET, leaving out the members that the client may not look up (see template.visible). The member urls
+// are left for the handler to fill in.
+func (reg *registry) describe(set *renewal_set, now time.Time, visible func(s Service) bool) Renewal_set {
+	members := make([]Renewal_member, 0, len(set.members))
+	for id, until := range set.members {
+		if e, ok := reg.entries[id]; visible != nil && (!ok || !visible(e.service)) {
+			continue
+		}
+		members = append(members, Renewal_member{ID: id, Remaining: inMilliseconds(earliest(until, set.expiry).Sub(now))})
+	}
+	return Renewal_set{Lease: inMilliseconds(set.expiry.Sub(now)), Members: members}
+}
+
+// POST the warning to the callback url of the set.
+func deliverWarning(callback string, warning Expiration_warning) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	b, _ := json.Marshal(warning)
+	resp, err := client.Post(callback, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		log.Println("Unable to deliver expiration warning:", callback, warning.Set, err)
+		return
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+// The wrapper func that is called when clients want to create a renewal set (POST to /renewal) or renew (PUT), examine (GET),
+// add an entry to (POST) or remove (DELETE) a renewal set.
+func Renewal(request_channel chan Request, urls *Advertised_urls, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	path := r.URL.Path
+	response_chan := make(chan response)
+	if !strings.HasPrefix(path, Renewal_url()) {
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		var s Renewal_set_request
+		err := readJSON(w, r, &s)
+		if err == nil {
+			err = validateLease(s.Lease)
+		}
+		if err == nil {
+			err = validateLease(s.Warning)
+		}
+		if err == nil && s.Callback != "" {
+			err = validateCallback(s.Callback)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		request_channel <- Request{q: "renewal_create", response_channel: response_chan, service: Service{Lease: s.Lease}, callback: s.Callback, warning: time.Duration(s.Warning) * time.Millisecond}
+		response := <-response_chan
+		url := urls.For(r, Renewal_url()+response.id)
+		b, _ := json.Marshal(Registration{Url: url, Lease: response.lease, Policy: response.policy, Token: response.token})
+		w.Header().Set("Location", url)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+		return
+	}
+
+	id := path[len(Renewal_url()):]
+	token := r.Header.Get(Lease_token_header)
+	switch r.Method {
+	case "PUT":
+		service, err := getService(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		request_channel <- Request{q: "renewal_renew", response_channel: response_chan, service: service, id: id, token: token}
+	case "GET":
+		request_channel <- Request{q: "renewal_get", response_channel: response_chan, id: id, template: template{visible: accessFor(r).visible()}}
+	case "POST":
+		var m Renewal_member_request
+		err := readJSON(w, r, &m)
+		if err == nil {
+			err = validateLease(m.Duration)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		i := strings.LastIndex(m.Url, Entry_url())
+		if i < 0 {
+			writeError(w, badRequest("The Url is not an entry url").with("Url", m.Url))
+			return
+		}
+		member := m.Url[i+len(Entry_url()):]
+		request_channel <- Request{q: "renewal_add", response_channel: response_chan, id: id, member: member, member_token: m.Token, token: token, deadline: time.Now().Add(time.Duration(m.Duration) * time.Millisecond)}
+	case "DELETE":
+		request_channel <- Request{q: "renewal_cancel", response_channel: response_chan, id: id, token: token}
+	default:
+		methodNotAllowed(w, "GET, PUT, POST, DELETE")
+		return
+	}
+	response := <-response_chan
+	switch {
+	case response.id == "":
+		writeError(w, newError(http.StatusNotFound, Code_lease_expired, "The renewal set has expired or been removed").with("ID", id))
+	case response.err != nil:
+		writeError(w, response.err.(*Error))
+	case r.Method == "PUT":
+		b, _ := json.Marshal(Registration{Url: urls.For(r, Renewal_url()+id), Lease: response.lease, Policy: response.policy})
+		w.Write(b)
+	case r.Method == "GET":
+		for i := range response.set.Members {
+			response.set.Members[i].Url = urls.For(r, Entry_url()+response.set.Members[i].ID)
+		}
+		b, _ := json.Marshal(response.set)
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Helper func to allow us to replace all the renewal set urls easily.
+func Renewal_url() string {
+	return "/renewal/"
+}
@@ -0,0 +1,161 @@
+package lus
+
+/**
+  Test that renewal sets keep their entries alive for as long as they were asked to, but no longer than the set itself.
+**/
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewalSetRenewsMembers(t *testing.T) {
+	now := time.Now()
+	reg := newRegistry(make(map[string]entry_state), NewMemoryStore())
+	reg.put("x", entry_state{service: Service{ID: "x"}, expiry: now.Add(1 * time.Second), version: 1})
+	set := &renewal_set{expiry: now.Add(10 * time.Second), members: map[string]time.Time{"x": now.Add(100 * time.Second)}}
+	reg.renewal_sets["s"] = set
+	policy := &Lease_policy{Max: 4000}
+	expiry := func() time.Duration { return reg.entries["x"].expiry.Sub(now) }
+
+	// Adding an entry renews it straight away, but never beyond the maximum lease.
+	reg.renewMember(set, "x", now, policy, true)
+	if expiry() != 4*time.Second || reg.entries["x"].version != 2 {
+		t.Fatalf("Expected the entry to be renewed to the maximum lease but got %v", expiry())
+	}
+	// Renewals wait until less than half of the lease that could be given is left.
+	reg.tickRenewalSets(now.Add(1*time.Second), policy)
+	if expiry() != 4*time.Second {
+		t.Fatalf("Expected the entry not to be renewed yet but got %v", expiry())
+	}
+	reg.tickRenewalSets(now.Add(2500*time.Millisecond), policy)
+	if expiry() != 6500*time.Millisecond {
+		t.Fatalf("Expected the entry to have been renewed but got %v", expiry())
+	}
+	// The entry is never kept alive beyond the set.
+	reg.tickRenewalSets(now.Add(5*time.Second), policy)
+	reg.tickRenewalSets(now.Add(8500*time.Millisecond), policy)
+	if expiry() != 10*time.Second {
+		t.Fatalf("Expected the entry to expire with the set but got %v", expiry())
+	}
+	reg.tickRenewalSets(now.Add(10*time.Second), policy)
+	if len(reg.renewal_sets) != 0 {
+		t.Fatal("Expected the set to have expired")
+	}
+
+	// Members whose time is up, or whose entry has gone, are dropped.
+	set = &renewal_set{expiry: now.Add(10 * time.Second), members: map[string]time.Time{"x": now.Add(1 * time.Second), "y": now.Add(5 * time.Second)}}
+	reg.renewal_sets["s"] = set
+	reg.tickRenewalSets(now.Add(2*time.Second), policy)
+	if len(set.members) != 0 {
+		t.Fatalf("Expected the members to have been dropped but got %v", set.members)
+	}
+}
+
+func TestRenewalSet(t *testing.T) {
+	root := start_test_lus(t, Options{MaxLease: 60000})
+	client := must_client(t, root)
+	keys := map[string]string{"application": "batch"}
+
+	warnings := make(chan Expiration_warning, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var warning Expiration_warning
+		json.NewDecoder(r.Body).Decode(&warning)
+		warnings <- warning
+	}))
+	defer callback.Close()
+
+	set, err := client.CreateRenewalSet(context.Background(), Renewal_set_request{Lease: 10000, Callback: callback.URL, Warning: 9500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := must_register(t, client, NewService(keys, 500, "", "batch123"))
+	if err := client.RenewFor(context.Background(), set, b, 2500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	assert_num_entries("renewed by the set", must_find(t, client, keys), 1)
+
+	select {
+	case w := <-warnings:
+		if w.Lease <= 0 || w.Lease > 9500 {
+			t.Fatalf("Expected the warning to say how long the set has left but got %v", w)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the expiration warning")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	assert_num_entries("membership over", must_find(t, client, keys), 0)
+
+	if err := client.Cancel(context.Background(), set); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Renew(context.Background(), set.Url, 10000); err == nil {
+		t.Fatal("Expected a removed set not to be renewed")
+	}
+	assert_status(t, "POST", root+"renewal", `{"Lease":-1}`, http.StatusBadRequest)
+	assert_status(t, "POST", root+"renewal", `{"Lease":10000,"Callback":"file:///etc/passwd"}`, http.StatusBadRequest)
+	assert_status(t, "GET", root+"renewal", "", http.StatusMethodNotAllowed)
+}
+
+// Test that a renewal set only lists the members that the client may look up.
+func TestRenewalSetAccess(t *testing.T) {
+	auth := Auth_config{
+		Tokens: []Auth_token{
+			{Token: "billing-token", Principal: Principal{Name: "billing-svc", Teams: []string{"billing"}}},
+			{Token: "ops-token", Principal: Principal{Name: "dashboard", Teams: []string{"ops"}}},
+		},
+		Rules: []Access_rule{
+			{Name: "billing", Teams: []string{"billing"}, Register: map[string]string{}, Lookup: map[string]string{}},
+			{Name: "ops", Teams: []string{"ops"}, Lookup: map[string]string{"env": "prod"}},
+		},
+	}
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	server := httptest.NewServer(NewAuthHandler(test_lus_handler(t, Options{MaxLease: 60000}, urls), auth))
+	defer server.Close()
+	ctx := context.Background()
+	billing := must_client(t, server.URL+"/", WithBearerToken("billing-token"))
+
+	set, err := billing.CreateRenewalSet(ctx, Renewal_set_request{Lease: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{} // The entry url of each member
+	for _, env := range []string{"prod", "dev"} {
+		r := must_register(t, billing, NewService(map[string]string{"env": env}, 10000, "", ""))
+		if err := billing.RenewFor(ctx, set, r, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		names[r.Url] = env
+	}
+	members := func(token string) []string {
+		r, _ := http.NewRequest("GET", set.Url, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var described Renewal_set
+		json.NewDecoder(resp.Body).Decode(&described)
+		envs := []string{}
+		for _, m := range described.Members {
+			envs = append(envs, names[m.Url])
+		}
+		sort.Strings(envs)
+		return envs
+	}
+	if envs := members("billing-token"); strings.Join(envs, ",") != "dev,prod" {
+		t.Fatalf("Expected billing to see every member but got %v", envs)
+	}
+	if envs := members("ops-token"); strings.Join(envs, ",") != "prod" {
+		t.Fatalf("Expected ops to only see the prod member but got %v", envs)
+	}
+}
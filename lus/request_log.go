@@ -0,0 +1,52 @@
+package lus
+
+/**
+  Optional logging of every request made to the LUS, which can be turned on and off while the LUS is running.
+**/
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Wraps a handler and logs every request that is made while logging is turned on.
+type Request_logger struct {
+	handler http.Handler
+	enabled atomic.Bool
+}
+
+// Creates a Request_logger for the handler.
+func NewRequestLogger(handler http.Handler, enabled bool) *Request_logger {
+	l := &Request_logger{handler: handler}
+	l.enabled.Store(enabled)
+	return l
+}
+
+// Turn logging on or off.
+func (l *Request_logger) SetEnabled(enabled bool) {
+	l.enabled.Store(enabled)
+}
+
+func (l *Request_logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !l.enabled.Load() {
+		l.handler.ServeHTTP(w, r)
+		return
+	}
+	start := time.Now()
+	sw := &status_writer{ResponseWriter: w, status: http.StatusOK}
+	l.handler.ServeHTTP(sw, r)
+	log.Println(r.RemoteAddr, r.Method, r.URL.RequestURI(), sw.status, time.Since(start))
+}
+
+// Remembers the status code that was sent.
+type status_writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *status_writer) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
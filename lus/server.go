@@ -26,14 +26,10 @@ To use, type: go run lus_server.go
 **/
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 )
 
@@ -43,10 +39,24 @@ type LinkRelation struct {
 	Href string
 }
 
+// The link relations that are handed out from the webroot.
+const (
+	Rel_register  = "http://rels.ewansilver.com/v1/lus/register"
+	Rel_find      = "http://rels.ewansilver.com/v1/lus/find"
+	Rel_notify    = "http://rels.ewansilver.com/v1/lus/notify"
+	Rel_gossip    = "http://rels.ewansilver.com/v1/lus/gossip"
+	Rel_renewal   = "http://rels.ewansilver.com/v1/lus/renewal"
+	Rel_group     = "http://rels.ewansilver.com/v1/lus/group"     // The Href is the name of a group that the LUS is a member of
+	Rel_namespace = "http://rels.ewansilver.com/v1/lus/namespace" // The Href is the root url of a namespace (see namespace.go)
+)
+
 // Internal struct to allow us to track when a particular Service will expire.
 type entry_state struct {
 	expiry  time.Time
 	service Service
+	version int64     // Bumped on every change so that peers can tell which copy of an entry is newer
+	granted time.Time // When the client was last granted a lease, so that it can be stopped from renewing too often
+	token   string    // Hash of the lease token that has to be sent to renew, modify or cancel the entry
 }
 
 // A shitty internal structure that is overloaded with multiple use cases but represents the various inbound requests and means
@@ -56,62 +66,212 @@ type Request struct {
 	response_channel chan response
 	service          Service
 	id               string
+	callback         string
+	index            int64
+	deadline         time.Time
+	versions         map[string]int64
+	gossip           []Gossip_entry
+	template         template
+	changes          []Attribute_change
+	version          int64 // The version the client expects the entry to be at. 0 means any version
+	member           string
+	member_token     string // The lease token of the member being added to a renewal set
+	token            string // The lease token the client sent
+	warning          time.Duration
+	options          Options
+	may_register     func(keys map[string]string) bool // Whether the client may register a Service with the keys
+	sent             time.Time                         // When a find was sent, so that the time spent queueing can be measured
+	key              string                            // The key to break the entries down by in the metrics
 }
 
 // As with request. It is the return value on all the chans.
 type response struct {
-	id      string
-	lease   int64
-	matches []Service
+	id       string
+	lease    int64
+	matches  []Service
+	index    int64
+	reset    bool
+	deltas   []Delta
+	versions map[string]int64
+	gossip   []Gossip_entry
+	version  int64
+	set      Renewal_set
+	policy   *Applied_policy
+	token    string // The lease token for something that has just been created
+	metrics  *metrics_snapshot
+	err      error
+}
+
+// Represents the JSON data struct that is sent to find. It is compatible with sending a Service as the template. Query is
+// optional and written in the query language described in query.go.
+type Find_request struct {
+	Keys   map[string]string
+	Groups []string
+	Query  string
 }
 
 // Represents the JSON data struct that lets clients know that a service has been succesfully registered.
 type Registration struct {
-	Url   string
-	Lease int64
+	Url    string
+	Lease  int64
+	Policy *Applied_policy `json:",omitempty"` // How the LUS decided on the Lease
+	Token  string          `json:",omitempty"` // Only sent when the registration is made. Send it in the Lease-Token header to renew, modify or cancel it
+}
+
+// Options that control how the Lus server behaves.
+type Options struct {
+	MaxLease float64       // Maximum lease time that will be handed out in ms
+	Store    Store         // Where registrations are persisted. Defaults to a memory store if nil.
+	Node     string        // Name of this LUS. Goes on the front of IDs so they are unique when federated with peers.
+	Groups   []string      // Groups this LUS is a member of. Registrations can only target these groups.
+	Policy   *Lease_policy // Decides how long a lease to grant. If nil every lease is just capped at MaxLease.
+
+	MaxEntries  int // The most entries before registrations are turned away, counting gossiped ones (which never are). 0 means no limit
+	MaxDataSize int // The biggest Data a Service can have in bytes. 0 means no limit
 }
 
+// How many requests can be queued up for the lus goroutine before the handlers have to wait to send them.
+const Request_queue_size = 64
+
 // Start the Lus server
 func Start(max_lease float64) chan Request {
-	request_chan := make(chan Request)
-	go lus(request_chan, max_lease)
+	request_chan, _ := StartWithStore(max_lease, NewMemoryStore())
 	return request_chan
 }
 
+// Start the Lus server, first recovering any registrations held in the store. Every subsequent change is written to the store.
+func StartWithStore(max_lease float64, store Store) (chan Request, error) {
+	return StartWithOptions(Options{MaxLease: max_lease, Store: store})
+}
+
+// Start the Lus server with the supplied Options.
+func StartWithOptions(options Options) (chan Request, error) {
+	if options.Store == nil {
+		options.Store = NewMemoryStore()
+	}
+	entries, err := recoverEntries(options.Store)
+	if err != nil {
+		return nil, err
+	}
+	// Compact what we have just replayed so the log only holds events from this run onwards.
+	err = options.Store.Snapshot(snapshotRecords(entries))
+	if err != nil {
+		return nil, err
+	}
+	request_chan := make(chan Request, Request_queue_size)
+	go lus(request_chan, options, newRegistry(entries, options.Store))
+	return request_chan, nil
+}
+
 // The core goroutine. Maintains the internal map of entries and orchestrates the various activities.
 // Kind of sucks that this has to be written within a for loop. Would much prefer to write it as a tail recursive call
 // and pass in all the params but it seems that Go is not optimised for tail recursion. WTF!!!
 // (eg see: https://groups.google.com/forum/#!msg/golang-nuts/0oIZPHhrDzY/2nCpUZDKZAAJ)
-func lus(c chan Request, max_lease float64) {
+func lus(c chan Request, options Options, reg *registry) {
 	tick_chan := time.Tick(1 * time.Second)
-	entries := make(map[string]entry_state)
-	var counter int64 = 0
+	var alarm expiry_timer
+	policy := newPolicyState(options)
 
 	for {
 		select {
 		case req := <-c:
 			switch req.q {
 			case "register": // Handles registration of new services
-				id := createUniqueID(counter)
-				counter++
-				expiry_time, lease_duration := getExpiryAndLease(req.service, max_lease)
-				entries[id] = entry_state{service: req.service, expiry: expiry_time}
-				req.response_channel <- response{id: id, lease: lease_duration}
+				groups, ok := acceptedGroups(req.service.Groups, options.Groups)
+				if !ok {
+					req.response_channel <- response{} // None of the targeted groups are ours.
+					break
+				}
+				if err := options.checkQuota(req.service, len(reg.entries)+1); err != nil {
+					req.response_channel <- response{err: err}
+					break
+				}
+				req.service.Groups = groups
+				req.service.Version = 0
+				id, token := nextUniqueID(options.Node, reg), newToken()
+				expiry_time, lease_duration, applied := policy.grant(req.service, true, len(reg.entries))
+				reg.put(id, entry_state{service: req.service, expiry: expiry_time, version: 1, granted: time.Now(), token: hashToken(token)})
+				reg.metrics.registrations++
+				reg.metrics.granted(req.service.Lease, lease_duration)
+				req.response_channel <- response{id: id, lease: lease_duration, policy: applied, token: token}
 			case "renew": // Allows clients to renew service leases
 				id := req.id
-				e, ok := entries[id]
-				if ok {
-					expiry_time, lease_duration := getExpiryAndLease(req.service, max_lease)
-					entries[id] = entry_state{service: e.service, expiry: expiry_time}
-					req.response_channel <- response{id: id, lease: lease_duration}
+				e, ok := reg.entries[id]
+				if ok && !tokenMatches(e.token, req.token) {
+					req.response_channel <- response{id: id, err: forbidden(id)}
+				} else if ok && !versionMatches(e, req.version) {
+					req.response_channel <- response{id: id, err: &Version_conflict{Version: e.version}}
+				} else if wait, too_soon := policy.tooSoon(e.granted, time.Now()); ok && too_soon && req.service.Lease > 0 {
+					req.response_channel <- response{id: id, err: renewingTooSoon(wait)}
+				} else if ok {
+					expiry_time, lease_duration, applied := policy.grant(Service{Keys: e.service.Keys, Lease: req.service.Lease}, false, len(reg.entries))
+					if lease_duration <= 0 { // A zero lease means the service is going away so drop it straight away.
+						reg.cancel(id)
+					} else {
+						e.granted = time.Now()
+						reg.renew(id, e, expiry_time)
+						reg.metrics.granted(req.service.Lease, lease_duration)
+					}
+					req.response_channel <- response{id: id, lease: lease_duration, version: e.version + 1, policy: applied}
+				} else {
+					req.response_channel <- response{} // Send an empty response to indicate nothing happened.
+				}
+			case "modify": // Allows clients to change the attributes of a service without re-registering it.
+				id := req.id
+				e, ok := reg.entries[id]
+				if !ok {
+					req.response_channel <- response{} // Send an empty response to indicate nothing happened.
+					break
+				}
+				if !tokenMatches(e.token, req.token) {
+					req.response_channel <- response{id: id, err: forbidden(id)}
+					break
+				}
+				if !versionMatches(e, req.version) {
+					req.response_channel <- response{id: id, err: &Version_conflict{Version: e.version}}
+					break
+				}
+				s, err := applyChanges(e.service, req.changes)
+				if err != nil {
+					req.response_channel <- response{id: id, err: err}
+					break
+				}
+				if err := options.checkQuota(s, len(reg.entries)); err != nil {
+					req.response_channel <- response{id: id, err: err}
+					break
+				}
+				if req.may_register != nil && !req.may_register(s.Keys) {
+					req.response_channel <- response{id: id, err: newError(http.StatusForbidden, Code_forbidden, "Not allowed to change the Service to these keys")}
+					break
+				}
+				e.service, e.version = s, e.version+1
+				reg.put(id, e)
+				req.response_channel <- response{id: id, matches: convertToServices(map[string]entry_state{id: e}), version: e.version}
+			case "cancel": // Allows clients to remove a service straight away.
+				e, ok := reg.entries[req.id]
+				if ok && !tokenMatches(e.token, req.token) {
+					req.response_channel <- response{id: req.id, err: forbidden(req.id)}
+				} else if ok && !versionMatches(e, req.version) {
+					req.response_channel <- response{id: req.id, err: &Version_conflict{Version: e.version}}
+				} else if ok {
+					reg.cancel(req.id)
+					req.response_channel <- response{id: req.id}
 				} else {
 					req.response_channel <- response{} // Send an empty response to indicate nothing happened.
 				}
 			case "find": // Allows clients to find all the entries that match a particular set of keys.
-				req.response_channel <- response{matches: findMatchingEntries(req.service.Keys, entries)}
+				matches := reg.find(req.template)
+				if !req.sent.IsZero() {
+					reg.metrics.find_duration.observe(time.Since(req.sent).Seconds())
+				}
+				req.response_channel <- response{matches: matches}
+			case "watch": // Allows clients to find the changes to the entries that match a particular set of keys.
+				reg.watches.watch(watcher{template: req.template, index: req.index, response_channel: req.response_channel}, reg.find)
+			case "unwatch": // Stops waiting on a parked watch that has run out of time or whose client has gone away.
+				reg.watches.unwatch(req.response_channel)
 			case "get_id": // Allows a client to find the specific entry.
 				id := req.id
-				e, ok := entries[id]
+				e, ok := reg.entries[id]
 				if ok {
 					m := map[string]entry_state{"key": e}
 					r := response{matches: convertToServices(m)}
@@ -119,38 +279,164 @@ func lus(c chan Request, max_lease float64) {
 				} else {
 					req.response_channel <- response{} // Send an empty response to indicate nothing happened.
 				}
+			case "notify": // Registers a listener that is told about changes to entries that match its template.
+				id, token := nextUniqueID(options.Node, reg), newToken()
+				expiry_time, lease_duration, applied := policy.grant(req.service, false, len(reg.entries))
+				reg.listeners[id] = newListener(req.template, req.callback, expiry_time, hashToken(token))
+				req.response_channel <- response{id: id, lease: lease_duration, policy: applied, token: token}
+			case "renew_notify": // Allows clients to renew the lease on a listener.
+				id := req.id
+				l, ok := reg.listeners[id]
+				if ok && !tokenMatches(l.token, req.token) {
+					req.response_channel <- response{id: id, err: forbidden(id)}
+				} else if ok {
+					expiry_time, lease_duration, applied := policy.grant(req.service, false, len(reg.entries))
+					l.expiry = expiry_time
+					req.response_channel <- response{id: id, lease: lease_duration, policy: applied}
+				} else {
+					req.response_channel <- response{}
+				}
+			case "digest": // Returns the versions of everything we know about so that we can gossip with a peer.
+				req.response_channel <- response{versions: reg.digest()}
+			case "gossip": // Returns everything we know that is newer than the versions a peer sent us.
+				req.response_channel <- response{gossip: reg.newerThan(req.versions)}
+			case "merge": // Merges in what a peer told us.
+				for _, g := range req.gossip {
+					reg.merge(g, time.Now())
+				}
+				req.response_channel <- response{}
+			case "metrics": // Returns the metrics for /metrics.
+				snapshot := metrics_snapshot{metrics: reg.metrics.snapshot(), entries: len(reg.entries)}
+				if req.key != "" {
+					snapshot.by_key = countByKey(reg.entries, req.key)
+				}
+				req.response_channel <- response{metrics: &snapshot}
+			case "reconfigure": // Swaps in a new lease policy.
+				policy.reconfigure(req.options)
+				req.response_channel <- response{}
+			case "renewal_create": // Creates a renewal set that keeps entries alive on behalf of a client.
+				id, token := nextUniqueID(options.Node, reg), newToken()
+				expiry_time, lease_duration, applied := policy.grant(req.service, false, len(reg.entries))
+				warning := req.warning
+				if warning == 0 {
+					warning = time.Duration(lease_duration/2) * time.Millisecond
+				}
+				reg.renewal_sets[id] = &renewal_set{expiry: expiry_time, callback: req.callback, warning: warning, token: hashToken(token), members: make(map[string]time.Time)}
+				req.response_channel <- response{id: id, lease: lease_duration, policy: applied, token: token}
+			case "renewal_renew": // Allows clients to renew the lease on a renewal set.
+				set, ok := reg.renewal_sets[req.id]
+				if !ok {
+					req.response_channel <- response{}
+					break
+				}
+				if !tokenMatches(set.token, req.token) {
+					req.response_channel <- response{id: req.id, err: forbidden(req.id)}
+					break
+				}
+				expiry_time, lease_duration, applied := policy.grant(req.service, false, len(reg.entries))
+				if lease_duration <= 0 {
+					delete(reg.renewal_sets, req.id)
+				} else {
+					set.expiry, set.warned = expiry_time, false
+					reg.renewMembers(set, time.Now(), policy.policy, true)
+				}
+				req.response_channel <- response{id: req.id, lease: lease_duration, policy: applied}
+			case "renewal_add": // Adds an entry to a renewal set, or takes it out again if its time is already up.
+				set, ok := reg.renewal_sets[req.id]
+				if !ok {
+					req.response_channel <- response{}
+					break
+				}
+				if !tokenMatches(set.token, req.token) {
+					req.response_channel <- response{id: req.id, err: forbidden(req.id)}
+					break
+				}
+				member, ok := reg.entries[req.member]
+				if !ok {
+					req.response_channel <- response{id: req.id, err: notFound(req.member)}
+					break
+				}
+				if !tokenMatches(member.token, req.member_token) { // Only the holder of a lease can hand it over to a set.
+					req.response_channel <- response{id: req.id, err: forbidden(req.member)}
+					break
+				}
+				set.members[req.member] = req.deadline
+				reg.renewMember(set, req.member, time.Now(), policy.policy, true)
+				req.response_channel <- response{id: req.id}
+			case "renewal_get": // Allows a client to examine a renewal set.
+				set, ok := reg.renewal_sets[req.id]
+				if ok {
+					req.response_channel <- response{id: req.id, set: reg.describe(set, time.Now(), req.template.visible)}
+				} else {
+					req.response_channel <- response{}
+				}
+			case "renewal_cancel": // Removes a renewal set, leaving its entries to run out their leases.
+				set, ok := reg.renewal_sets[req.id]
+				if ok && !tokenMatches(set.token, req.token) {
+					req.response_channel <- response{id: req.id, err: forbidden(req.id)}
+				} else if ok {
+					delete(reg.renewal_sets, req.id)
+					req.response_channel <- response{id: req.id}
+				} else {
+					req.response_channel <- response{}
+				}
 
 			default:
 				log.Println("**** stateful_routine DEFAULT. Shouldn't be here! :", req)
 			}
-		case <-tick_chan: // Cleans out stale entries.
-			entries = filterBy(removeStaleEntries(), entries)
+		case <-alarm.wait(reg.expiries): // Removes entries as soon as their leases are up.
+			alarm.stop()
+			reg.expire(time.Now())
+		case <-tick_chan: // Cleans out stale tombstones, listeners and watches and renews the entries in renewal sets.
+			now := time.Now()
+			reg.tick(now)
+			reg.tickRenewalSets(now, policy.policy)
+			policy.tick()
 		}
 	}
 }
 
-// Returns the new lease and the expiry time based on the requested_lease
+// Returns the new lease and the expiry time based on the requested_lease when there is no policy other than the max_lease.
 func getExpiryAndLease(entry Service, max_lease float64) (time.Time, int64) {
-	requested_lease := float64(entry.Lease)
-	lease_duration := time.Duration(math.Min(requested_lease, max_lease))
-	expiry_time := time.Now().Add(lease_duration * time.Millisecond)
-	return expiry_time, inMilliseconds(lease_duration * time.Millisecond)
+	lease_duration, _ := (&Lease_policy{Max: int64(max_lease)}).grant(entry.Keys, entry.Lease, false, 0)
+	return time.Now().Add(time.Duration(lease_duration) * time.Millisecond), lease_duration
 }
 
-// Find the Services that match the supplied templates
-func findMatchingEntries(templates map[string]string, entries map[string]entry_state) []Service {
-	for k, v := range templates {
-		entries = filterBy(matchesEntryState(k, v), entries)
+// Find the Services that match the supplied template. The keys are looked up in the index so that only the entries that have
+// all of them are looked at, then the groups and query are checked against just those.
+func findMatchingEntries(t template, entries map[string]entry_state, index attribute_index) []Service {
+	rest := template{groups: t.groups, query: t.query, visible: t.visible}
+	matches := make(map[string]entry_state)
+	if len(t.keys) == 0 {
+		for id, e := range entries {
+			if matchesTemplate(rest, e) {
+				matches[id] = e
+			}
+		}
+		return convertToServices(matches)
+	}
+	for _, id := range index.lookup(t.keys) {
+		e := entries[id]
+		if matchesTemplate(rest, e) {
+			matches[id] = e
+		}
 	}
-	return convertToServices(entries)
+	return convertToServices(matches)
 }
 
-// Helper func that allows us to hack in a unique ID for every entry. Obviously this is deterministic but it is my first Go app so give me a break!
-func createUniqueID(counter int64) string {
-	data := strconv.AppendInt([]byte("Some random stuff that isn't really random but will do for our purposes...."), counter, 10)
-	hasher := sha1.New()
-	hasher.Write(data)
-	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+// The groups that a registration will end up in. Targeting groups that this LUS is not a member of is not ok. A LUS that isn't a
+// member of any groups doesn't restrict what can be targeted.
+func acceptedGroups(targeted []string, member_of []string) ([]string, bool) {
+	if len(targeted) == 0 || len(member_of) == 0 {
+		return targeted, true
+	}
+	accepted := []string{}
+	for _, g := range targeted {
+		if inGroups(member_of, []string{g}) {
+			accepted = append(accepted, g)
+		}
+	}
+	return accepted, len(accepted) > 0
 }
 
 //
@@ -162,7 +448,7 @@ func convertToServices(entries map[string]entry_state) []Service {
 		expiry_time := entry.expiry
 		remaining_lease := inMilliseconds(expiry_time.Sub(now)) // Get the remaining lease in milliseconds
 		if remaining_lease > 0 {
-			array = append(array, Service{Lease: remaining_lease, Data: entry.service.Data, Keys: entry.service.Keys, ID: entry.service.ID})
+			array = append(array, Service{Lease: remaining_lease, Data: entry.service.Data, Keys: entry.service.Keys, ID: entry.service.ID, Groups: entry.service.Groups, Version: entry.version})
 		}
 	}
 	return array
@@ -182,6 +468,38 @@ func removeStaleEntries() func(e entry_state) bool {
 	}
 }
 
+// Internal struct for what a client is looking for. Every key/value pair must match, if any groups are given the entry must
+// be in one of them and, if there is a query, it must match too.
+type template struct {
+	keys    map[string]string
+	groups  []string
+	query   query_expr
+	visible func(s Service) bool // Hides the Services the client may not look up. Nil if it may see them all
+}
+
+// Creates the template for a find, watch or notify. Fails if the query can't be parsed.
+func newTemplate(keys map[string]string, groups []string, query string) (template, error) {
+	expr, err := parseQuery(query)
+	return template{keys: keys, groups: groups, query: expr}, err
+}
+
+// Does the entry match the template?
+func matchesTemplate(t template, e entry_state) bool {
+	for k, v := range t.keys {
+		if !matchesEntryState(k, v)(e) {
+			return false
+		}
+	}
+	return (len(t.groups) == 0 || inEntryGroups(t.groups)(e)) && (t.query == nil || t.query.matches(e)) && (t.visible == nil || t.visible(e.service))
+}
+
+// Finds all the entries that are in one of the groups. An entry that didn't target any groups is in all of them. Is passed into filterBy
+func inEntryGroups(groups []string) func(e entry_state) bool {
+	return func(e entry_state) bool {
+		return len(e.service.Groups) == 0 || inGroups(e.service.Groups, groups)
+	}
+}
+
 // Finds all the entries that match the supplier key/value pair. Is passed into filterBy
 func matchesEntryState(key string, value string) func(e entry_state) bool {
 	return func(s entry_state) bool {
@@ -206,70 +524,192 @@ func filterBy(filter func(e entry_state) bool, maps map[string]entry_state) map[
 }
 
 // Extract the Service that was passed over the wire as JSON from the http.Request.
-func getService(b *http.Request) Service {
-	body, err := ioutil.ReadAll(b.Body)
+func getService(w http.ResponseWriter, r *http.Request) (Service, *Error) {
+	var s Service
+	err := readJSON(w, r, &s)
 	if err != nil {
-		panic("l")
+		return s, err
 	}
-	var s Service
-	err = json.Unmarshal(body, &s)
+	return s, validateService(s)
+}
+
+// Extract the template that was passed over the wire as a JSON Find_request from the http.Request.
+func getTemplate(w http.ResponseWriter, r *http.Request) (template, *Error) {
+	var f Find_request
+	err := readJSON(w, r, &f)
 	if err != nil {
-		panic(err)
+		return template{}, err
 	}
-	return s
+	t, query_err := newTemplate(f.Keys, f.Groups, f.Query)
+	if query_err != nil {
+		return template{}, badRequest(query_err.Error()).with("Query", f.Query)
+	}
+	t.visible = accessFor(r).visible()
+	return t, nil
 }
 
 // The wrapper func that is called when clients want to register a new entry.
-func Register(request_channel chan Request, port int, w http.ResponseWriter, r *http.Request) {
-	service := getService(r)
+func Register(request_channel chan Request, urls *Advertised_urls, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	service, err := getService(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if access := accessFor(r); !access.mayRegister(service.Keys) {
+		writeError(w, notAllowed(access.who(), "Not allowed to register a Service with these keys"))
+		return
+	}
 	response_chan := make(chan response)
 	request_struct := Request{q: "register", response_channel: response_chan, service: service}
 	request_channel <- request_struct
 	response := <-response_chan
+	if e, ok := response.err.(*Error); ok {
+		writeError(w, e)
+		return
+	}
+	if response.id == "" {
+		writeError(w, badRequest("This LUS is not a member of any of the targeted groups").with("Groups", strings.Join(service.Groups, ",")))
+		return
+	}
 
-	b, _ := json.Marshal(Registration{Url: "http://localhost:" + strconv.Itoa(port) + Entry_url() + response.id, Lease: response.lease})
+	url := urls.For(r, Entry_url()+response.id)
+	b, _ := json.Marshal(Registration{Url: url, Lease: response.lease, Policy: response.policy, Token: response.token})
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
 	w.Write(b)
 }
 
-// The wrapper func that is called when clients either want to update (via PUT) or examine (via GET) a specific entry
-func Entry(request_channel chan Request, port int, w http.ResponseWriter, r *http.Request) {
+// The wrapper func that is called when clients either want to renew (via PUT), examine (via GET), modify (via PATCH) or remove
+// (via DELETE) a specific entry
+func Entry(request_channel chan Request, urls *Advertised_urls, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	path := r.URL.Path
+	id := path[7:len(path)]
 	if r.Method == "PUT" {
-		path := r.URL.Path
-		id := path[7:len(path)]
+		service, err := getService(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		response_chan := make(chan response)
-		request_channel <- Request{q: "renew", response_channel: response_chan, service: getService(r), id: id}
+		request_channel <- Request{q: "renew", response_channel: response_chan, service: service, id: id, version: expectedVersion(r), token: r.Header.Get(Lease_token_header)}
 		response := <-response_chan
-		b, _ := json.Marshal(Registration{Url: "http://localhost:" + strconv.Itoa(port) + Entry_url() + response.id, Lease: response.lease})
+		if response.id == "" {
+			writeError(w, newError(http.StatusNotFound, Code_lease_expired, "The lease has expired or been cancelled").with("ID", id))
+			return
+		}
+		if conflict, ok := response.err.(*Version_conflict); ok {
+			preconditionFailed(w, conflict.Version)
+			return
+		}
+		if e, ok := response.err.(*Error); ok {
+			if retry := e.Details["Retry-After"]; retry != "" {
+				w.Header().Set("Retry-After", retry)
+			}
+			writeError(w, e)
+			return
+		}
+		if response.version > 0 {
+			w.Header().Set("ETag", etagFor(response.version))
+		}
+		b, _ := json.Marshal(Registration{Url: urls.For(r, Entry_url()+response.id), Lease: response.lease, Policy: response.policy})
 		w.Write(b)
 	} else if r.Method == "GET" {
-		path := r.URL.Path
-		id := path[7:len(path)]
 		response_chan := make(chan response)
 		request_channel <- Request{q: "get_id", response_channel: response_chan, id: id}
 		response := <-response_chan
+		if len(response.matches) == 0 || !accessFor(r).mayLookup(response.matches[0].Keys) {
+			writeError(w, notFound(id))
+			return
+		}
+		version := response.matches[0].Version
+		w.Header().Set("ETag", etagFor(version))
+		if notModified(r, version) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		b, _ := json.Marshal(response.matches)
 		w.Write(b)
+	} else if r.Method == "PATCH" {
+		modifyEntry(request_channel, id, w, r)
+	} else if r.Method == "DELETE" {
+		response_chan := make(chan response)
+		request_channel <- Request{q: "cancel", response_channel: response_chan, id: id, version: expectedVersion(r), token: r.Header.Get(Lease_token_header)}
+		response := <-response_chan
+		if response.id == "" {
+			writeError(w, notFound(id))
+			return
+		}
+		if e, ok := response.err.(*Error); ok {
+			writeError(w, e)
+			return
+		}
+		if conflict, ok := response.err.(*Version_conflict); ok {
+			preconditionFailed(w, conflict.Version)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	} else {
-		panic("Wrong method")
+		methodNotAllowed(w, "GET, PUT, PATCH, DELETE")
 	}
 }
 
 // Wrapper func that is called to allow clients to find all Entries that match the supplied Entry JSON.
+// If the watch param is true then the request is handed over to Watch.
 func Find(request_channel chan Request, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	if r.URL.Query().Get("watch") == "true" {
+		Watch(request_channel, w, r)
+		return
+	}
+	t, err := getTemplate(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	response_chan := make(chan response)
-	request_channel <- Request{q: "find", response_channel: response_chan, service: getService(r)}
+	request_channel <- Request{q: "find", response_channel: response_chan, template: t, sent: time.Now()}
 	response := <-response_chan
 	b, _ := json.Marshal(response.matches)
 	w.Write(b)
 }
 
 // An example of a HATEOAS webroot that will allow us to alter the exact URLS called for register etc in a later iteration.
-func Root_handler(port int, w http.ResponseWriter, r *http.Request) {
-	rels := []LinkRelation{LinkRelation{Href: "http://localhost:" + strconv.Itoa(port) + "/register", Rel: "http://rels.ewansilver.com/v1/lus/register"}, LinkRelation{Href: "http://localhost:" + strconv.Itoa(port) + "/find", Rel: "http://rels.ewansilver.com/v1/lus/find"}}
-	b, _ := json.Marshal(rels)
+// The groups that the LUS is a member of are also listed as link relations.
+func Root_handler(urls *Advertised_urls, groups []string, w http.ResponseWriter, r *http.Request) {
+	b, _ := json.Marshal(rootLinks(urls, groups, r))
 	w.Write(b)
 }
 
+// The link relations for the webroot.
+func rootLinks(urls *Advertised_urls, groups []string, r *http.Request) []LinkRelation {
+	rels := []LinkRelation{LinkRelation{Href: urls.For(r, "/register"), Rel: Rel_register}, LinkRelation{Href: urls.For(r, "/find"), Rel: Rel_find}, LinkRelation{Href: urls.For(r, "/notify"), Rel: Rel_notify}, LinkRelation{Href: urls.For(r, Gossip_url()), Rel: Rel_gossip}, LinkRelation{Href: urls.For(r, "/renewal"), Rel: Rel_renewal}}
+	for _, g := range groups {
+		rels = append(rels, LinkRelation{Href: g, Rel: Rel_group})
+	}
+	return rels
+}
+
+// The handlers for a LUS that is using the request channel, mounted at the root.
+func Routes(request_chan chan Request, urls *Advertised_urls, groups []string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { Root_handler(urls, groups, w, r) })
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) { Register(request_chan, urls, w, r) })
+	mux.HandleFunc("/find", func(w http.ResponseWriter, r *http.Request) { Find(request_chan, w, r) })
+	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) { Notify(request_chan, urls, w, r) })
+	mux.HandleFunc(Notify_url(), func(w http.ResponseWriter, r *http.Request) { Notify(request_chan, urls, w, r) })
+	mux.HandleFunc(Gossip_url(), func(w http.ResponseWriter, r *http.Request) { Gossip(request_chan, w, r) })
+	mux.HandleFunc(Entry_url(), func(w http.ResponseWriter, r *http.Request) { Entry(request_chan, urls, w, r) })
+	mux.HandleFunc("/renewal", func(w http.ResponseWriter, r *http.Request) { Renewal(request_chan, urls, w, r) })
+	mux.HandleFunc(Renewal_url(), func(w http.ResponseWriter, r *http.Request) { Renewal(request_chan, urls, w, r) })
+	return mux
+}
+
 // Helper func to allow us to replace all the entry urls easily.
 func Entry_url() string {
 	return "/entry/"
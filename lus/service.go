@@ -10,6 +10,9 @@ type Service struct {
 	Lease int64  // Lease time in ms
 	Data  string
 	Keys  map[string]string
+
+	Groups  []string `json:",omitempty"` // The groups this Service is registered in (or, for a find, looked up in). Empty means all of them.
+	Version int64    `json:",omitempty"` // The version of the entry, which goes up every time it changes. Set by the LUS
 }
 
 // Initialises and returns a new Client.
@@ -0,0 +1,177 @@
+package lus
+
+/**
+  Persistence for the LUS registrations. The core lus goroutine writes every register/renew/expire event to a Store as it happens
+  and periodically replaces the log with a snapshot of the live entries. On startup the snapshot and log are replayed so that a
+  restarted LUS comes back with the same registrations (and the same expiry times) that it had before it went down.
+**/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A single event in the write ahead log. Renew and expire records only need the ID and (for renew) the new expiry.
+type Record struct {
+	Op      string // One of "register", "renew" or "expire"
+	ID      string
+	Expiry  time.Time
+	Version int64
+	Service Service
+	Token   string `json:",omitempty"` // Hash of the lease token
+}
+
+// A Store persists the registrations held by the lus goroutine. It is only ever called from that goroutine so implementations
+// do not need to worry about locking.
+type Store interface {
+	Append(record Record) error      // Append a single event to the log.
+	Snapshot(records []Record) error // Replace everything stored so far with the supplied register records.
+	Replay() ([]Record, error)       // Return the last snapshot followed by every event appended since.
+}
+
+// Store that keeps nothing. Used when the LUS is running without a data directory.
+type memory_store struct{}
+
+// Returns a Store that does not persist anything i.e. the original behaviour of forgetting everything on restart.
+func NewMemoryStore() Store {
+	return memory_store{}
+}
+
+func (s memory_store) Append(record Record) error      { return nil }
+func (s memory_store) Snapshot(records []Record) error { return nil }
+func (s memory_store) Replay() ([]Record, error)       { return nil, nil }
+
+// Store that writes a JSON lines log and a JSON snapshot into a directory.
+type file_store struct {
+	dir string
+	wal *os.File
+}
+
+const (
+	wal_file      = "wal.log"
+	snapshot_file = "snapshot.json"
+)
+
+// Returns a Store that persists into the supplied directory, creating it if needed.
+func NewFileStore(dir string) (Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, wal_file), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &file_store{dir: dir, wal: wal}, nil
+}
+
+// Append the record as a single line and sync it so that it survives a crash.
+func (s *file_store) Append(record Record) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.wal.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// Write the snapshot to a temp file and rename it into place before truncating the log. If we die between the two steps then
+// replaying the old log on top of the new snapshot is harmless as every record carries an absolute expiry time.
+func (s *file_store) Snapshot(records []Record) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, snapshot_file+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(s.dir, snapshot_file))
+	if err != nil {
+		return err
+	}
+	return s.wal.Truncate(0)
+}
+
+// Read back the snapshot followed by the log. A torn final line (e.g. we crashed half way through a write) is dropped.
+func (s *file_store) Replay() ([]Record, error) {
+	records := []Record{}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, snapshot_file))
+	if err == nil {
+		err = json.Unmarshal(b, &records)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(s.dir, wal_file))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), len(b)+1)
+	for scanner.Scan() {
+		var r Record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			log.Println("Dropping unreadable record from the log:", err)
+			break
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Rebuild the entries map from a store. Entries keep the expiry they had before the restart and anything that expired while we
+// were down is discarded.
+func recoverEntries(store Store) (map[string]entry_state, error) {
+	entries := make(map[string]entry_state)
+	records, err := store.Replay()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		switch r.Op {
+		case "register":
+			entries[r.ID] = entry_state{service: r.Service, expiry: r.Expiry, version: r.Version, token: r.Token}
+		case "renew":
+			e, ok := entries[r.ID]
+			if ok {
+				e.expiry, e.version = r.Expiry, r.Version
+				entries[r.ID] = e
+			}
+		case "expire":
+			delete(entries, r.ID)
+		}
+	}
+	return filterBy(removeStaleEntries(), entries), nil
+}
+
+// Converts the live entries into the register records that make up a snapshot.
+func snapshotRecords(entries map[string]entry_state) []Record {
+	records := make([]Record, 0, len(entries))
+	for id, e := range entries {
+		records = append(records, Record{Op: "register", ID: id, Expiry: e.expiry, Version: e.version, Service: e.service, Token: e.token})
+	}
+	return records
+}
@@ -0,0 +1,62 @@
+package lus
+
+/**
+  Test that registrations survive being written to and replayed from a file Store.
+**/
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Minute).Round(0)
+	renewed := expiry.Add(time.Minute)
+	store.Append(Record{Op: "register", ID: "a", Expiry: expiry, Service: Service{ID: "a123", Keys: map[string]string{"application": "poller"}}})
+	store.Append(Record{Op: "register", ID: "b", Expiry: expiry, Service: Service{ID: "b123"}})
+	store.Append(Record{Op: "register", ID: "stale", Expiry: time.Now().Add(-time.Minute), Service: Service{ID: "c123"}})
+	store.Snapshot(snapshotRecords(map[string]entry_state{
+		"a":     entry_state{expiry: expiry, service: Service{ID: "a123", Keys: map[string]string{"application": "poller"}}, token: "hash"},
+		"b":     entry_state{expiry: expiry, service: Service{ID: "b123"}},
+		"stale": entry_state{expiry: time.Now().Add(-time.Minute), service: Service{ID: "c123"}},
+	}))
+	store.Append(Record{Op: "renew", ID: "a", Expiry: renewed})
+	store.Append(Record{Op: "expire", ID: "b"})
+
+	// Simulate a crash half way through writing a record.
+	f, _ := os.OpenFile(filepath.Join(dir, wal_file), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"Op":"register","ID":"torn"`)
+	f.Close()
+
+	restarted, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := recoverEntries(restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry to be recovered but got %v", len(entries))
+	}
+	a, ok := entries["a"]
+	if !ok {
+		t.Fatal("Entry a was not recovered")
+	}
+	if !a.expiry.Equal(renewed) {
+		t.Fatalf("Recovered expiry %v is different to renewed expiry %v", a.expiry, renewed)
+	}
+	if a.token != "hash" {
+		t.Fatalf("Expected the lease token hash to be recovered but got %v", a.token)
+	}
+	assert_contains("application", "poller", a.service.Keys)
+	assert_id(a.service, "a123")
+}
@@ -0,0 +1,132 @@
+package lus
+
+/**
+  Serving https, and optionally verifying client certificates (mutual TLS). The certificate, key and client CA are read from
+  PEM files and read again whenever the files change, or when Reload is called, so a certificate can be renewed without
+  restarting the LUS. Each new connection uses whatever was loaded last. If the files can't be read (e.g. because they are
+  half way through being replaced) the old ones are kept and the reload is tried again next time.
+**/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Holds the certificate and client CAs for serving https, reloading them when the files change.
+type Cert_reloader struct {
+	cert_file      string
+	key_file       string
+	client_ca_file string
+	require        bool // Must clients present a certificate?
+
+	mutex       sync.Mutex // Guards everything below
+	certificate *tls.Certificate
+	client_cas  *x509.CertPool
+	modified    time.Time // The newest modification time of the files when they were loaded
+}
+
+// Loads the certificate and key, and the client CAs if a file is given. If require is true then clients must present a certificate
+// signed by one of the client CAs, otherwise a certificate is only checked if the client sends one.
+func NewCertReloader(cert_file string, key_file string, client_ca_file string, require bool) (*Cert_reloader, error) {
+	c := &Cert_reloader{cert_file: cert_file, key_file: key_file, client_ca_file: client_ca_file, require: require}
+	return c, c.Reload()
+}
+
+// Reads the files again.
+func (c *Cert_reloader) Reload() error {
+	modified := c.lastModified()
+	certificate, err := tls.LoadX509KeyPair(c.cert_file, c.key_file)
+	if err != nil {
+		return errors.New("tls: " + err.Error())
+	}
+	var client_cas *x509.CertPool
+	if c.client_ca_file != "" {
+		client_cas, err = LoadCertPool(c.client_ca_file)
+		if err != nil {
+			return err
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.certificate, c.client_cas, c.modified = &certificate, client_cas, modified
+	return nil
+}
+
+// The newest modification time of the files.
+func (c *Cert_reloader) lastModified() time.Time {
+	var newest time.Time
+	for _, file := range []string{c.cert_file, c.key_file, c.client_ca_file} {
+		if info, err := os.Stat(file); file != "" && err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+// Checks the files every interval and reloads them if any of them have changed. Stops when the done chan is closed.
+func (c *Cert_reloader) Watch(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.mutex.Lock()
+			loaded := c.modified
+			c.mutex.Unlock()
+			if !c.lastModified().After(loaded) {
+				continue
+			}
+			if err := c.Reload(); err != nil {
+				log.Println("Unable to reload the certificate, keeping the old one:", err)
+			} else {
+				log.Println("Reloaded the certificate:", c.cert_file)
+			}
+		}
+	}
+}
+
+// The protocols offered to clients, which are the ones http.Server adds to its own tls.Config. The config for each connection
+// replaces that one so has to offer them itself or every connection falls back to HTTP/1.1.
+var next_protos = []string{"h2", "http/1.1"}
+
+// The tls.Config to serve with. Every new connection picks up the certificate and client CAs that were loaded last.
+func (c *Cert_reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: next_protos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			config := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: next_protos, Certificates: []tls.Certificate{*c.certificate}}
+			if c.client_cas != nil {
+				config.ClientCAs = c.client_cas
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if c.require {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// The certificates in a PEM file e.g. a CA bundle for WithRootCAs or the client CAs.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("tls: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("tls: there are no certificates in " + file)
+	}
+	return pool, nil
+}
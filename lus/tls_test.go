@@ -0,0 +1,225 @@
+package lus
+
+/**
+  Test https and mutual TLS with certificates that are generated on the fly, and that a renewed certificate is picked up
+  without a restart.
+**/
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A CA that signs the certificates for a test.
+type test_ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func new_test_ca(t *testing.T) *test_ca {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "golus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &test_ca{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// Issues a certificate for localhost (if it is for a server) or a client, returning the PEM certificate and key.
+func (ca *test_ca) issue(t *testing.T, subject pkix.Name, server bool) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+}
+
+func (ca *test_ca) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func write_file(t *testing.T, file string, contents []byte) string {
+	err := ioutil.WriteFile(file, contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Serves the handler over https on a free port and returns its root url.
+func serve_tls(t *testing.T, handler http.Handler, config *tls.Config) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, TLSConfig: config}
+	go server.ServeTLS(listener, "", "") // As main does, so that http.Server sets up HTTP/2
+	t.Cleanup(func() { server.Close() })
+	return "https://localhost:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port) + "/"
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := new_test_ca(t)
+	cert_pem, key_pem := ca.issue(t, pkix.Name{CommonName: "localhost"}, true)
+	certs, err := NewCertReloader(write_file(t, filepath.Join(dir, "cert.pem"), cert_pem), write_file(t, filepath.Join(dir, "key.pem"), key_pem), write_file(t, filepath.Join(dir, "ca.pem"), ca.pem), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, _ := NewAdvertisedUrls("", "", nil)
+	root := serve_tls(t, NewAuthHandler(test_lus_handler(t, Options{MaxLease: 60000}, urls), Auth_config{ClientCerts: true}), certs.TLSConfig())
+	ctx := context.Background()
+
+	if _, err := NewClient(ctx, root); err == nil {
+		t.Fatal("Expected a client that doesn't trust the CA to fail")
+	}
+	if _, err := NewClient(ctx, root, WithRootCAs(ca.pool())); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected a client without a certificate to be turned away but got %v", err)
+	}
+	client_cert, client_key := ca.issue(t, pkix.Name{CommonName: "billing-svc", OrganizationalUnit: []string{"billing"}}, false)
+	certificate, _ := tls.X509KeyPair(client_cert, client_key)
+	client := must_client(t, root, WithRootCAs(ca.pool()), WithClientCertificate(certificate))
+	r := must_register(t, client, NewService(map[string]string{"application": "secure"}, 10000, "", "s123"))
+	if !strings.HasPrefix(r.Url, "https://localhost:") {
+		t.Fatalf("Expected an https url but got %v", r.Url)
+	}
+	if _, err := client.Renew(ctx, r.Url, 10000); err != nil {
+		t.Fatal(err)
+	}
+
+	other := new_test_ca(t)
+	other_cert, other_key := other.issue(t, pkix.Name{CommonName: "billing-svc"}, false)
+	certificate, _ = tls.X509KeyPair(other_cert, other_key)
+	if _, err := NewClient(ctx, root, WithRootCAs(ca.pool()), WithClientCertificate(certificate)); err == nil {
+		t.Fatal("Expected a certificate from another CA to be turned down")
+	}
+}
+
+// The CN of the certificate that the server is using.
+func served_name(t *testing.T, addr string, pool *x509.CertPool) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := new_test_ca(t)
+	cert_file, key_file := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert_pem, key_pem := ca.issue(t, pkix.Name{CommonName: "one"}, true)
+	write_file(t, cert_file, cert_pem)
+	write_file(t, key_file, key_pem)
+	certs, err := NewCertReloader(cert_file, key_file, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := serve_tls(t, http.NotFoundHandler(), certs.TLSConfig())
+	addr := strings.TrimSuffix(strings.TrimPrefix(root, "https://"), "/")
+	if name := served_name(t, addr, ca.pool()); name != "one" {
+		t.Fatalf("Expected the first certificate but got %v", name)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go certs.Watch(10*time.Millisecond, done)
+	cert_pem, key_pem = ca.issue(t, pkix.Name{CommonName: "two"}, true)
+	write_file(t, cert_file, cert_pem)
+	write_file(t, key_file, key_pem)
+	later := time.Now().Add(time.Second) // Make sure the change is seen even if the clock is coarse
+	os.Chtimes(cert_file, later, later)
+	os.Chtimes(key_file, later, later)
+	for i := 0; served_name(t, addr, ca.pool()) != "two"; i++ {
+		if i == 100 {
+			t.Fatal("Expected the renewed certificate to be picked up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	write_file(t, cert_file, []byte("half written"))
+	if err := certs.Reload(); err == nil {
+		t.Fatal("Expected a broken certificate not to be loaded")
+	}
+	if name := served_name(t, addr, ca.pool()); name != "two" {
+		t.Fatalf("Expected the last good certificate to be kept but got %v", name)
+	}
+}
+
+// Test that HTTP/2 is offered even though each connection gets a tls.Config of its own.
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := new_test_ca(t)
+	cert_pem, key_pem := ca.issue(t, pkix.Name{CommonName: "localhost"}, true)
+	certs, err := NewCertReloader(write_file(t, filepath.Join(dir, "cert.pem"), cert_pem), write_file(t, filepath.Join(dir, "key.pem"), key_pem), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := serve_tls(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.Proto)) }), certs.TLSConfig())
+
+	conn, err := tls.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(root, "https://"), "/"), &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		t.Fatalf("Expected HTTP/2 to be negotiated but got %q", protocol)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if proto, _ := ioutil.ReadAll(resp.Body); string(proto) != "HTTP/2.0" {
+		t.Fatalf("Expected the request to be served over HTTP/2 but got %v", string(proto))
+	}
+}
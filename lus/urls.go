@@ -0,0 +1,156 @@
+package lus
+
+/**
+  The urls that the LUS hands out (in Registrations, Location headers and the links from the webroot) have to work from wherever
+  the client is, which isn't necessarily the same machine, and the LUS may well be sitting behind a reverse proxy or mounted
+  under a path prefix such as /lus/. If the base url is configured then it is always used. Otherwise it is worked out from each
+  request: the Host the client asked for, https if the request came in over TLS and the path prefix the LUS is mounted at. When
+  the request comes from a trusted proxy its Forwarded (RFC 7239) or X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix
+  headers are believed instead. Those headers are ignored from anyone else as they would let a client have us hand out urls
+  pointing anywhere.
+**/
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Works out the urls to hand out to clients.
+type Advertised_urls struct {
+	base_url        string         // Used for every url if it isn't empty
+	prefix          string         // The path the LUS is mounted at e.g. /lus
+	trusted_proxies []netip.Prefix // The forwarded headers are only believed from these addresses
+}
+
+// Creates the Advertised_urls. The base_url (e.g. https://lus.example.com/lus/) is optional, the prefix is the path the handlers
+// are mounted at and the trusted proxies are IP addresses or CIDR ranges.
+func NewAdvertisedUrls(base_url string, prefix string, trusted_proxies []string) (*Advertised_urls, error) {
+	urls := &Advertised_urls{base_url: strings.TrimSuffix(base_url, "/"), prefix: cleanPrefix(prefix)}
+	for _, proxy := range trusted_proxies {
+		p, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		urls.trusted_proxies = append(urls.trusted_proxies, p)
+	}
+	return urls, nil
+}
+
+// A path prefix in the form /lus, or empty for the root.
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// An IP address or CIDR range.
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		p, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return p, errors.New("urls: not a CIDR range: " + proxy)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, errors.New("urls: not an IP address: " + proxy)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Did the request come from one of the trusted proxies?
+func (urls *Advertised_urls) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range urls.trusted_proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The base url for the request, without a trailing slash e.g. https://lus.example.com/lus
+func (urls *Advertised_urls) Base(r *http.Request) string {
+	if urls.base_url != "" {
+		return urls.base_url
+	}
+	scheme, host, prefix := "http", r.Host, urls.prefix
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if urls.trusted(r) {
+		proto, forwarded_host := parseForwarded(r.Header.Get("Forwarded"))
+		if proto == "" {
+			proto = firstValue(r.Header.Get("X-Forwarded-Proto"))
+		}
+		if forwarded_host == "" {
+			forwarded_host = firstValue(r.Header.Get("X-Forwarded-Host"))
+		}
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if validHost(forwarded_host) {
+			host = forwarded_host
+		}
+		prefix = cleanPrefix(firstValue(r.Header.Get("X-Forwarded-Prefix"))) + prefix
+	}
+	return scheme + "://" + host + prefix
+}
+
+// The url for a path (e.g. /register) on the LUS.
+func (urls *Advertised_urls) For(r *http.Request, path string) string {
+	return urls.Base(r) + path
+}
+
+// The urls for something that is mounted at a path within the LUS e.g. a namespace.
+func (urls *Advertised_urls) Under(path string) *Advertised_urls {
+	under := *urls
+	if under.base_url != "" {
+		under.base_url += cleanPrefix(path)
+	} else {
+		under.prefix += cleanPrefix(path)
+	}
+	return &under
+}
+
+// The proto and host from the first (i.e. client facing) element of a Forwarded header e.g. for=192.0.2.60;proto=https;host=example.com
+func parseForwarded(header string) (string, string) {
+	var proto, host string
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		v = strings.Trim(v, `"`)
+		switch strings.ToLower(k) {
+		case "proto":
+			proto = strings.ToLower(v)
+		case "host":
+			host = v
+		}
+	}
+	return proto, host
+}
+
+// The first of a comma separated list of header values. Proxies add themselves to the end.
+func firstValue(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(first)
+}
+
+// Could this be a host[:port]? Stops a header being used to smuggle a path or anything else into the urls we hand out.
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, "/\\?#@ \t")
+}
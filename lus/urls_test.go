@@ -0,0 +1,94 @@
+package lus
+
+/**
+  Test that the urls handed out work from where the client is, behind proxies and under a path prefix.
+**/
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdvertisedUrls(t *testing.T) {
+	derived, _ := NewAdvertisedUrls("", "/lus/", []string{"10.0.0.0/8", "::1"})
+	fixed, _ := NewAdvertisedUrls("https://lus.example.com/golus/", "/lus", nil)
+	tests := []struct {
+		urls     *Advertised_urls
+		remote   string
+		tls      bool
+		headers  map[string]string
+		expected string
+	}{
+		{derived, "192.0.2.1:1234", false, nil, "http://lus.local:3000/lus"},
+		{derived, "192.0.2.1:1234", true, nil, "https://lus.local:3000/lus"},
+		{derived, "192.0.2.1:1234", false, map[string]string{"X-Forwarded-Host": "evil.example.com", "X-Forwarded-Proto": "https"}, "http://lus.local:3000/lus"},
+		{derived, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Host": "lus.example.com, 10.1.2.3", "X-Forwarded-Proto": "https", "X-Forwarded-Prefix": "/edge"}, "https://lus.example.com/edge/lus"},
+		{derived, "[::1]:1234", false, map[string]string{"Forwarded": `for=192.0.2.60;proto=https;host="lus.example.com:8443", for=10.1.2.3`, "X-Forwarded-Host": "other.example.com"}, "https://lus.example.com:8443/lus"},
+		{derived, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Host": "evil.example.com/path", "X-Forwarded-Proto": "gopher"}, "http://lus.local:3000/lus"},
+		{fixed, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Host": "lus.example.com"}, "https://lus.example.com/golus"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://lus.local:3000/lus/", nil)
+		r.RemoteAddr = test.remote
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if base := test.urls.Base(r); base != test.expected {
+			t.Fatalf("Expected %v from %v %v but got %v", test.expected, test.remote, test.headers, base)
+		}
+	}
+	if _, err := NewAdvertisedUrls("", "", []string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("Expected an invalid trusted proxy to be rejected")
+	}
+}
+
+// Test that every url handed out by a LUS mounted under a prefix can be used.
+func TestUrlsUnderPrefix(t *testing.T) {
+	urls, _ := NewAdvertisedUrls("", "/lus", []string{"127.0.0.1", "::1"})
+	root := serve_test_lus(t, Options{MaxLease: 60000}, urls, "/lus")
+	client := must_client(t, root)
+	keys := map[string]string{"application": "prefixed"}
+
+	r := must_register(t, client, NewService(keys, 10000, "", "prefixed123"))
+	if !strings.HasPrefix(r.Url, root+"entry/") {
+		t.Fatalf("Expected the entry url to be under %v but got %v", root, r.Url)
+	}
+	if _, err := client.Renew(context.Background(), r.Url, 10000); err != nil {
+		t.Fatal(err)
+	}
+	assert_num_entries("prefixed", must_find(t, client, keys), 1)
+	set, err := client.CreateRenewalSet(context.Background(), Renewal_set_request{Lease: 10000})
+	if err != nil || !strings.HasPrefix(set.Url, root+"renewal/") {
+		t.Fatalf("Expected the renewal set url to be under %v but got %v %v", root, set.Url, err)
+	}
+	if err := client.RenewFor(context.Background(), set, r, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Cancel(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	// A proxy in front of the LUS gets links to itself.
+	req, _ := http.NewRequest("GET", root, nil)
+	req.Header.Set("X-Forwarded-Host", "lus.example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	links := []LinkRelation{}
+	json.NewDecoder(resp.Body).Decode(&links)
+	if len(links) == 0 || links[0].Href != "https://lus.example.com/lus/register" {
+		t.Fatalf("Expected links through the proxy but got %v", links)
+	}
+}
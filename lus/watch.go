@@ -0,0 +1,205 @@
+package lus
+
+/**
+  Long-poll watches on /find. Every change to the entries bumps a monotonic registry index and is kept in a short history. A client
+  calls /find?watch=true&index=N and gets back every added/removed/updated Service that matches its template since index N along
+  with the new index to use on the next call. If nothing has changed then the call is parked until something does (or the wait
+  runs out). A client that has no index, or whose index has fallen out of the history (e.g. it was disconnected for a long time or
+  the LUS restarted), is sent a full reset containing all the current matches. Each parked call has its own timer in the handler,
+  which takes it back out of the waiting list (with an unwatch request) when its wait runs out or the client goes away.
+**/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The types of change that a Delta can describe.
+const (
+	DeltaAdded   = "added"
+	DeltaRemoved = "removed"
+	DeltaUpdated = "updated"
+)
+
+// How many changes we remember for clients that want to resume a watch.
+const watch_history = 1000
+
+// How long we will park a watch that has nothing to report before returning an empty response.
+const default_watch_wait = 30 * time.Second
+
+// How many watches we will park at once by default. Any more are turned away with a 429.
+const max_waiting_watches = 10000
+
+// A single change to a Service that matches the watch template.
+type Delta struct {
+	Type    string
+	Service Service
+}
+
+// Represents the JSON data struct that is returned from a watch.
+type Watch_response struct {
+	Index  int64 // Pass this back in on the next watch to resume from here
+	Reset  bool  // If true then Deltas contains every current match and the client should throw away what it already has
+	Deltas []Delta
+}
+
+// Internal struct that records a change to an entry at a particular index.
+type change struct {
+	index  int64
+	before *entry_state
+	after  *entry_state
+}
+
+// Internal struct for a watch that is parked waiting for something to happen.
+type watcher struct {
+	template         template
+	index            int64
+	response_channel chan response
+}
+
+// Internal struct that holds the registry index, the recent history and any parked watches. Owned by the lus goroutine.
+type watch_state struct {
+	index   int64
+	changes []change
+	waiting []watcher
+}
+
+// Creates the watch state. The index starts from the current time so that an index handed out before a restart is always older
+// than anything we know about and so gets a reset rather than a misleading set of deltas.
+func newWatchState() *watch_state {
+	return &watch_state{index: time.Now().UnixNano()}
+}
+
+// Record a change to an entry and wake up any parked watches that care about it. Renewals that don't alter a Service are not
+// interesting to watchers so don't use up any history.
+func (ws *watch_state) record(before *entry_state, after *entry_state) {
+	if before != nil && after != nil && !attributesChanged(before.service, after.service) {
+		return
+	}
+	ws.index++
+	c := change{index: ws.index, before: before, after: after}
+	ws.changes = append(ws.changes, c)
+	if len(ws.changes) > watch_history {
+		ws.changes = append([]change(nil), ws.changes[len(ws.changes)-watch_history:]...)
+	}
+
+	// A parked watch has already seen everything before this change, so only this change needs checking.
+	waiting := ws.waiting[:0]
+	for _, w := range ws.waiting {
+		if d, ok := deltaFor(w.template, c); ok {
+			w.response_channel <- response{index: ws.index, deltas: []Delta{d}}
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	ws.waiting = waiting
+}
+
+// Answer a watch straight away if we can, otherwise park it until something changes. The response_channel must be buffered so
+// that we never block on a client that has given up waiting.
+func (ws *watch_state) watch(w watcher, find func(t template) []Service) {
+	oldest := ws.index - int64(len(ws.changes))
+	if w.index <= 0 || w.index > ws.index || w.index < oldest {
+		matches := find(w.template)
+		deltas := make([]Delta, 0, len(matches))
+		for _, s := range matches {
+			deltas = append(deltas, Delta{Type: DeltaAdded, Service: s})
+		}
+		w.response_channel <- response{index: ws.index, reset: true, deltas: deltas}
+		return
+	}
+	deltas := ws.deltasSince(w.template, w.index)
+	if len(deltas) > 0 {
+		w.response_channel <- response{index: ws.index, deltas: deltas}
+		return
+	}
+	if len(ws.waiting) >= currentLimits().MaxWatches {
+		w.response_channel <- response{err: newError(http.StatusTooManyRequests, Code_too_many_requests, "Too many watches are waiting")}
+		return
+	}
+	ws.waiting = append(ws.waiting, w)
+}
+
+// Take the watch that is answered on the response_channel out of the waiting list and send it an empty response. Does nothing
+// if it has already been answered.
+func (ws *watch_state) unwatch(response_channel chan response) {
+	for i, w := range ws.waiting {
+		if w.response_channel == response_channel {
+			ws.waiting = append(ws.waiting[:i], ws.waiting[i+1:]...)
+			w.response_channel <- response{index: ws.index, deltas: []Delta{}}
+			return
+		}
+	}
+}
+
+// All the deltas for the template after the supplied index.
+func (ws *watch_state) deltasSince(t template, index int64) []Delta {
+	deltas := []Delta{}
+	for _, c := range ws.changes {
+		if c.index <= index {
+			continue
+		}
+		if d, ok := deltaFor(t, c); ok {
+			deltas = append(deltas, d)
+		}
+	}
+	return deltas
+}
+
+// The delta for the template that a change makes, if it makes one.
+func deltaFor(t template, c change) (Delta, bool) {
+	transition, service := transitionFor(t, c.before, c.after)
+	switch transition {
+	case TransitionNoMatchMatch:
+		return Delta{Type: DeltaAdded, Service: service}, true
+	case TransitionMatchNoMatch:
+		return Delta{Type: DeltaRemoved, Service: service}, true
+	case TransitionMatchMatch:
+		return Delta{Type: DeltaUpdated, Service: service}, true
+	}
+	return Delta{}, false
+}
+
+// Wrapper func that is called when a client adds watch=true to a find. The optional index param is the index returned by the
+// previous watch and the optional wait param (e.g. 10s) is how long to park the request for if nothing has changed.
+func Watch(request_channel chan Request, w http.ResponseWriter, r *http.Request) {
+	defer recoverErrors(w)
+	query := r.URL.Query()
+	index, _ := strconv.ParseInt(query.Get("index"), 10, 64)
+	wait := default_watch_wait
+	if d, err := time.ParseDuration(query.Get("wait")); err == nil && d < wait {
+		wait = d
+	}
+
+	t, err := getTemplate(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response_chan := make(chan response, 1)
+	request_channel <- Request{q: "watch", response_channel: response_chan, template: t, index: index}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var resp response
+	select {
+	case resp = <-response_chan:
+	case <-timer.C:
+		request_channel <- Request{q: "unwatch", response_channel: response_chan}
+		resp = <-response_chan // Either the empty response or whatever beat the unwatch to it
+	case <-r.Context().Done():
+		request_channel <- Request{q: "unwatch", response_channel: response_chan} // Give up the slot
+		return
+	}
+	if resp.err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, resp.err.(*Error))
+		return
+	}
+	watch_response := Watch_response{Index: resp.index, Reset: resp.reset, Deltas: resp.deltas}
+	b, _ := json.Marshal(watch_response)
+	w.Header().Set("X-Lus-Index", strconv.FormatInt(watch_response.Index, 10))
+	w.Write(b)
+}
@@ -0,0 +1,47 @@
+package lus
+
+/**
+  Test that parked watches are woken by the changes they care about.
+**/
+
+import (
+	"testing"
+)
+
+func TestParkedWatch(t *testing.T) {
+	ws := newWatchState()
+	prod := template{keys: map[string]string{"env": "prod"}}
+	start := ws.index
+	ws.record(nil, &entry_state{service: Service{ID: "d1", Keys: map[string]string{"env": "dev"}}})
+
+	responses := make(chan response, 1)
+	ws.watch(watcher{template: prod, index: start, response_channel: responses}, func(template) []Service { return nil })
+	if len(ws.waiting) != 1 {
+		t.Fatal("Expected the watch to be parked as nothing it cares about has changed")
+	}
+	ws.record(nil, &entry_state{service: Service{ID: "d2", Keys: map[string]string{"env": "dev"}}})
+	if len(ws.waiting) != 1 {
+		t.Fatal("Expected the watch to stay parked for a change it doesn't care about")
+	}
+	ws.record(nil, &entry_state{service: Service{ID: "p1", Keys: map[string]string{"env": "prod"}}})
+	r := <-responses
+	if r.index != ws.index || len(r.deltas) != 1 || r.deltas[0].Type != DeltaAdded || r.deltas[0].Service.ID != "p1" || len(ws.waiting) != 0 {
+		t.Fatalf("Expected the watch to be woken with just the new Service but got %v", r)
+	}
+}
+
+// A change with every one of the watch limit parked, none of which care about it.
+func BenchmarkRecordWithParkedWatches(b *testing.B) {
+	ws := newWatchState()
+	for i := 0; i < watch_history; i++ {
+		ws.record(nil, &entry_state{service: Service{ID: "d", Keys: map[string]string{"env": "dev"}}})
+	}
+	for i := 0; i < max_waiting_watches; i++ {
+		ws.waiting = append(ws.waiting, watcher{template: template{keys: map[string]string{"env": "prod"}}, index: ws.index, response_channel: make(chan response, 1)})
+	}
+	before, after := &entry_state{service: Service{ID: "d", Keys: map[string]string{"env": "dev"}}}, &entry_state{service: Service{ID: "d", Data: "x", Keys: map[string]string{"env": "dev"}}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ws.record(before, after)
+	}
+}
@@ -7,7 +7,9 @@ example but allows me to learn Go - this is my Hello World on Go!
 The core idea is that service providers register a set of name/value pairs that describe themselves with one or more LUS instances by POSTting a JSON
 document along with a requested lease time. The LUS will accept the registration and returns a URL and a lease time (in ms) that it will hold onto
 the service registration for. The service provider is then responsible for renewing the registration before the lease expires by PUTting a new lease
-request. If it does not renew the lease then the LUS will drop the service registration.
+request. If it does not renew the lease then the LUS will drop the service registration. A provider that is shutting down can DELETE its
+registration URL to be dropped straight away. A provider that can't stay running to renew its own lease can hand it over to
+a renewal set on the LUS (see lus/renewal.go).
 
 Clients who want to make use of the service are able to look up suitably registered services by passing in a set of key/value pairs that describe
 the characteristsics that they wish the service to provide. The example in the client.go harness is of two poller applications that register in
@@ -24,44 +26,324 @@ around maintaing a strongly consistent view of the services on the network.
 
 To use, type: go run main.go
 
+Settings can be given in a JSON config file (see lus/config.go), overridden by GOLUS_* environment variables (e.g.
+GOLUS_MAX_LEASE=60000), which are in turn overridden by any command line params. Sending a SIGHUP reloads the config file and
+environment and applies the lease policy and access rules (of the LUS and of each namespace), limits, logging and auth
+settings straight away, and reloads the TLS certificate. Who can use the LUS is set up in the Auth section of the config file
+(see lus/auth.go). Namespaces, each with a registry, lease policy, quotas and access rules of its own, are set up in the
+Namespaces section (see lus/namespace.go). Prometheus metrics are served from /metrics (see lus/metrics.go).
+
 Command line params:
--p <PORT> : default 3000
+-config <FILE> : default none - JSON config file
+-listen <HOST:PORT> : default :3000 - address to listen on
+-base-url <URL> : default none - url that clients reach the LUS on, otherwise it is worked out from each request
+-prefix <PATH> : default none - path to serve the LUS under e.g. /lus
+-trusted-proxies <CIDR,CIDR,...> : default none - proxies whose X-Forwarded-* and Forwarded headers are believed
+-p <PORT> : default 3000 - port to listen on, on every interface
 -m <MAX_LEASE_IN_MS> : default 120000 - two minutes
+-policy <FILE> : default none - JSON lease policy file (see lus/policy.go), -m is used for any maximum it leaves out
+-d <DATA_DIR> : default none - directory to persist registrations in so they survive a restart
+-peers <URL,URL,...> : default none - root urls of other LUS instances to federate with
+-node <NAME> : default <HOSTNAME>:<PORT> - name of this LUS, must be unique amongst its peers
+-g <GOSSIP_INTERVAL_IN_MS> : default 1000 - how often to gossip with the peers
+-groups <GROUP,GROUP,...> : default none - groups this LUS is a member of
+-announce <ANNOUNCE_INTERVAL_IN_MS> : default 0 - how often to announce this LUS over multicast, 0 disables announcements
+-announce-addr <HOST:PORT> : default 224.0.1.84:4160 - address announcements are sent to
+-request-addr <HOST:PORT> : default 224.0.1.85:4160 - address discovery requests are listened for on
+-tls-cert <FILE> : default none - PEM certificate to serve https with, reloaded when it changes
+-tls-key <FILE> : default none - PEM key for the certificate
+-tls-client-ca <FILE> : default none - PEM CAs to verify client certificates against (mutual TLS)
 **/
 
 import (
 	"flag"
 	"golus/lus"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	flagSet = flag.NewFlagSet("golus", flag.ExitOnError)
 
-	portFlag = flagSet.Int("p", 3000, "Port to run on.")
-	mlFlag   = flagSet.Int("m", 120000, "Maximum lease time that will be handed out in milliseconds")
+	configFlag = flagSet.String("config", "", "JSON config file")
+	listenFlag = flagSet.String("listen", ":3000", "Address to listen on")
+	baseFlag   = flagSet.String("base-url", "", "Url that clients reach the LUS on. If empty it is worked out from each request")
+	prefixFlag = flagSet.String("prefix", "", "Path to serve the LUS under e.g. /lus")
+	proxyFlag  = flagSet.String("trusted-proxies", "", "Comma separated IP addresses or CIDR ranges of proxies whose forwarded headers are believed")
+	portFlag   = flagSet.Int("p", 3000, "Port to listen on, on every interface")
+	mlFlag     = flagSet.Int("m", 120000, "Maximum lease time that will be handed out in milliseconds")
+	dataFlag   = flagSet.String("d", "", "Directory to persist registrations in. If empty registrations are only held in memory")
+	policyFlag = flagSet.String("policy", "", "JSON lease policy file. If empty every lease is just capped at the maximum lease")
+	peersFlag  = flagSet.String("peers", "", "Comma separated root urls of other LUS instances to federate with")
+	nodeFlag   = flagSet.String("node", "", "Name of this LUS. Must be unique amongst its peers. Defaults to <hostname>:<port>")
+	gossipFlag = flagSet.Int("g", 1000, "How often to gossip with the peers in milliseconds")
+	groupsFlag = flagSet.String("groups", "", "Comma separated groups that this LUS is a member of")
+
+	announceFlag     = flagSet.Int("announce", 0, "How often to announce this LUS over multicast in milliseconds. 0 disables announcements")
+	announceAddrFlag = flagSet.String("announce-addr", lus.Default_announce_addr, "Address that announcements are sent to")
+	requestAddrFlag  = flagSet.String("request-addr", lus.Default_request_addr, "Address that discovery requests are listened for on")
+
+	tlsCertFlag     = flagSet.String("tls-cert", "", "PEM certificate to serve https with. Reloaded when it changes")
+	tlsKeyFlag      = flagSet.String("tls-key", "", "PEM key for the certificate")
+	tlsClientCAFlag = flagSet.String("tls-client-ca", "", "PEM CAs to verify client certificates against")
 )
 
+// Load the config file and environment, apply any command line params that were given and check the result.
+func loadConfig() (lus.Config, error) {
+	config, err := lus.LoadConfig(*configFlag, os.Environ())
+	if err != nil {
+		return config, err
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = *listenFlag
+		case "p":
+			config.Listen = ":" + strconv.Itoa(*portFlag)
+		case "base-url":
+			config.BaseURL = *baseFlag
+		case "prefix":
+			config.PathPrefix = *prefixFlag
+		case "trusted-proxies":
+			config.TrustedProxies = strings.Split(*proxyFlag, ",")
+		case "m":
+			config.MaxLease = int64(*mlFlag)
+		case "d":
+			config.Store = lus.Store_config{Type: "file", Dir: *dataFlag}
+		case "policy":
+			config.PolicyFile, config.Policy = *policyFlag, nil
+		case "peers":
+			config.Peers = strings.Split(*peersFlag, ",")
+		case "node":
+			config.Node = *nodeFlag
+		case "g":
+			config.GossipInterval = int64(*gossipFlag)
+		case "groups":
+			config.Groups = strings.Split(*groupsFlag, ",")
+		case "announce":
+			config.Announce = int64(*announceFlag)
+		case "announce-addr":
+			config.AnnounceAddr = *announceAddrFlag
+		case "request-addr":
+			config.RequestAddr = *requestAddrFlag
+		case "tls-cert":
+			config.TLS.Cert = *tlsCertFlag
+		case "tls-key":
+			config.TLS.Key = *tlsKeyFlag
+		case "tls-client-ca":
+			config.TLS.ClientCA = *tlsClientCAFlag
+		}
+	})
+	return config, config.Validate()
+}
+
+// Send the log to the file, or stderr if there isn't one. Returns the file so that it can be closed when the log moves on.
+func openLog(file string) (io.Closer, error) {
+	if file == "" {
+		log.SetOutput(os.Stderr)
+		return nil, nil
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(f)
+	return f, nil
+}
+
 // Main func to get the system up and running.
 func main() {
 	// Process flags
 	flagSet.Parse(os.Args[1:])
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalln("Invalid configuration:\n" + err.Error())
+	}
+	log_file, err := openLog(config.Log.File)
+	if err != nil {
+		log.Fatalln("Unable to open log file:", err)
+	}
 
-	var port int = *portFlag
-	var max_lease float64 = float64(*mlFlag)
+	port := config.Port()
+	max_lease := float64(config.MaxLease)
+	hostname, _ := os.Hostname()
+	urls, _ := config.AdvertisedUrls() // Already checked by Validate
 
 	log.Println("LUS Server")
-	log.Println("Running on http://localhost:", port)
+	if config.BaseURL != "" {
+		log.Println("Listening on", config.Listen+config.Prefix(), "as", config.BaseURL)
+	} else {
+		log.Println("Listening on", config.Listen+config.Prefix())
+	}
 	log.Println("Maxlease (ms):", max_lease)
 
-	request_chan := lus.Start(max_lease)
+	store := lus.NewMemoryStore()
+	if config.Store.Type == "file" {
+		log.Println("Data directory:", config.Store.Dir)
+		store, err = lus.NewFileStore(config.Store.Dir)
+		if err != nil {
+			log.Fatalln("Unable to open data directory:", err)
+		}
+	}
+	node := config.Node
+	if node == "" {
+		node = hostname + ":" + strconv.Itoa(port)
+	}
+	groups := config.Groups
+	if len(groups) > 0 {
+		log.Println("Groups:", groups)
+	}
+	policy, _ := config.LeasePolicy() // Already checked by Validate
+	if policy != nil {
+		log.Println("Lease policy:", config.PolicyFile)
+	}
+	lus.SetLimits(config.Limits)
+	request_chan, err := lus.StartWithOptions(lus.Options{MaxLease: max_lease, Store: store, Node: node, Groups: groups, Policy: policy})
+	if err != nil {
+		log.Fatalln("Unable to recover registrations:", err)
+	}
+	var credentials []lus.Client_option // For gossiping with the peers
+	if config.Auth.PeerToken != "" {
+		credentials = append(credentials, lus.WithBearerToken(config.Auth.PeerToken))
+	}
+	if config.TLS.PeerCA != "" {
+		pool, err := lus.LoadCertPool(config.TLS.PeerCA)
+		if err != nil {
+			log.Fatalln("Unable to load the peer CA:", err)
+		}
+		credentials = append(credentials, lus.WithRootCAs(pool))
+	}
+	gossip_interval := time.Duration(config.GossipInterval) * time.Millisecond
+	if len(config.Peers) > 0 {
+		log.Println("Node:", node, "gossiping with peers:", config.Peers)
+		lus.StartGossip(request_chan, config.Peers, gossip_interval, credentials...)
+	}
+	namespaces := lus.NewNamespaces(lus.Routes(request_chan, urls, groups), urls, groups)
+	request_chans := map[string]chan lus.Request{"": request_chan} // By namespace, for the metrics
+	for _, ns := range config.Namespaces {
+		ns_store := lus.NewMemoryStore()
+		if config.Store.Type == "file" {
+			ns_store, err = lus.NewFileStore(filepath.Join(config.Store.Dir, "ns", ns.Name))
+			if err != nil {
+				log.Fatalln("Unable to open data directory for namespace "+ns.Name+":", err)
+			}
+		}
+		ns_options := ns.LeaseOptions(config.MaxLease)
+		ns_options.Store, ns_options.Node, ns_options.Groups, ns_options.MaxEntries, ns_options.MaxDataSize = ns_store, node, groups, ns.MaxEntries, ns.MaxDataSize
+		ns_chan, err := lus.StartWithOptions(ns_options)
+		if err != nil {
+			log.Fatalln("Unable to recover registrations for namespace "+ns.Name+":", err)
+		}
+		if len(ns.Peers) > 0 {
+			lus.StartGossip(ns_chan, ns.Peers, gossip_interval, credentials...)
+		}
+		namespaces.Add(ns.Name, ns_chan, ns.Rules)
+		request_chans[ns.Name] = ns_chan
+		log.Println("Namespace:", ns.Name, "max entries:", ns.MaxEntries, "federated with:", ns.Peers)
+	}
+	if config.Announce > 0 {
+		base_url := config.BaseURL
+		if base_url == "" {
+			scheme := "http://"
+			if config.TLS.Cert != "" {
+				scheme = "https://"
+			}
+			base_url = scheme + hostname + ":" + strconv.Itoa(port) + config.Prefix() + "/"
+		}
+		_, err := lus.StartAnnouncer(base_url, groups, config.AnnounceAddr, config.RequestAddr, time.Duration(config.Announce)*time.Millisecond)
+		if err != nil {
+			log.Fatalln("Unable to start announcing:", err)
+		}
+		log.Println("Announcing", base_url, "on", config.AnnounceAddr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", namespaces)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		lus.Metrics(request_chans, config.MetricsKey, namespaces.MayScrape, w, r)
+	})
+	var routes http.Handler = mux
+	if prefix := config.Prefix(); prefix != "" {
+		routes = http.StripPrefix(prefix, mux)
+	}
+	auth := lus.NewAuthHandler(routes, config.Auth)
+	if config.Auth.Enabled() {
+		log.Println("Credentials are needed, anonymous access:", config.Auth.Anonymous)
+	}
+	handler := lus.NewRequestLogger(auth, config.Log.Requests)
+
+	server := &http.Server{Addr: config.Listen, Handler: handler}
+	var certs *lus.Cert_reloader
+	if config.TLS.Cert != "" {
+		certs, err = lus.NewCertReloader(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA, config.TLS.RequireClientCert)
+		if err != nil {
+			log.Fatalln("Unable to load the certificate:", err)
+		}
+		server.TLSConfig = certs.TLSConfig()
+		if config.TLS.ReloadInterval > 0 {
+			go certs.Watch(time.Duration(config.TLS.ReloadInterval)*time.Millisecond, nil)
+		}
+		log.Println("Serving https with:", config.TLS.Cert)
+		if config.TLS.ClientCA != "" {
+			log.Println("Verifying client certificates against:", config.TLS.ClientCA, "required:", config.TLS.RequireClientCert)
+		}
+	}
+
+	// Reload the settings that can be changed while we are running whenever we get a SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloaded, err := loadConfig()
+			if err != nil {
+				log.Println("Not reloading, invalid configuration:\n" + err.Error())
+				continue
+			}
+			policy, _ := reloaded.LeasePolicy()
+			lus.Reconfigure(request_chan, lus.Options{MaxLease: float64(reloaded.MaxLease), Policy: policy})
+			for _, ns := range reloaded.Namespaces {
+				if ns_chan, ok := request_chans[ns.Name]; ok { // A namespace that has been added has to wait for a restart
+					lus.Reconfigure(ns_chan, ns.LeaseOptions(reloaded.MaxLease))
+					namespaces.SetRules(ns.Name, ns.Rules)
+				}
+			}
+			lus.SetLimits(reloaded.Limits)
+			handler.SetEnabled(reloaded.Log.Requests)
+			auth.SetConfig(reloaded.Auth)
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Println("Unable to reload the certificate, keeping the old one:", err)
+				}
+			}
+			reopened, err := openLog(reloaded.Log.File) // Lets the log be rotated
+			if err != nil {
+				log.Println("Unable to open log file, keeping the old one:", err)
+			} else {
+				if log_file != nil {
+					log_file.Close()
+				}
+				log_file = reopened
+			}
+			log.Println("Reloaded configuration")
+			if restart := config.RestartRequired(reloaded); len(restart) > 0 {
+				log.Println("These settings have changed but need a restart:", strings.Join(restart, ", "))
+			}
+		}
+	}()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { lus.Root_handler(port, w, r) })
-	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) { lus.Register(request_chan, port, w, r) })
-	http.HandleFunc("/find", func(w http.ResponseWriter, r *http.Request) { lus.Find(request_chan, w, r) })
-	http.HandleFunc(lus.Entry_url(), func(w http.ResponseWriter, r *http.Request) { lus.Entry(request_chan, port, w, r) })
-	http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	var serve_err error
+	if certs != nil {
+		serve_err = server.ListenAndServeTLS("", "") // The certificate comes from the TLSConfig
+	} else {
+		serve_err = server.ListenAndServe()
+	}
+	log.Fatalln("Unable to serve:", serve_err)
 }